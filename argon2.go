@@ -1,8 +1,8 @@
 package authlib
 
 import (
+	"context"
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"strings"
 
@@ -10,10 +10,7 @@ import (
 	"golang.org/x/crypto/argon2"
 )
 
-var (
-	errInvalidHash         = errors.New("the encoded hash is not in the correct format")
-	errIncompatibleVersion = errors.New("incompatible version of argon2")
-)
+var errIncompatibleVersion = fmt.Errorf("%w: incompatible version of argon2", ErrInvalidHash)
 
 type params struct {
 	memory      uint32
@@ -44,20 +41,88 @@ func argon2Hash(password string, memory, iterations uint32) (encodedHash string)
 	return encodedHash
 }
 
+// HashParams are the argon2id parameters a hash was computed with.
+type HashParams struct {
+	Memory      uint32 // In kibibytes
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32 // In bytes
+	KeyLength   uint32 // In bytes
+}
+
+// HashPasswordWithParams hashes a password with the given memory (in megabytes)
+// and iterations, as HashPassword does with those of the config. Useful for
+// hashing outside of a running app, e.g. to seed an admin user.
+func HashPasswordWithParams(password string, memory, iterations uint32) string {
+	return argon2Hash(password, memory, iterations)
+}
+
+// DecodeHash returns the parameters of an encoded hash, e.g. to find hashes
+// that should be rehashed with stronger parameters. Errors match ErrInvalidHash.
+func DecodeHash(encodedHash string) (HashParams, error) {
+	p, _, _, err := decodeHash(encodedHash)
+	if err != nil {
+		return HashParams{}, err
+	}
+	return HashParams{
+		Memory:      p.memory,
+		Iterations:  p.iterations,
+		Parallelism: p.parallelism,
+		SaltLength:  p.saltLength,
+		KeyLength:   p.keyLength,
+	}, nil
+}
+
 func quickHash(password string) (hash string) {
 	return argon2Hash(password, 16, 2)
 }
 
+// hashQueue limits the number of argon2 hashes computed at once, as each one
+// holds on to its memory until done. A nil queue has no limit.
+type hashQueue chan struct{}
+
+func newHashQueue(size int) hashQueue {
+	if size <= 0 {
+		return nil
+	}
+	return make(hashQueue, size)
+}
+
+// acquire waits for a free slot, returning the context's error if it is done first.
+// release must be called once the hash has been computed.
+func (q hashQueue) acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if q == nil {
+		return nil
+	}
+	select {
+	case q <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q hashQueue) release() {
+	if q != nil {
+		<-q
+	}
+}
+
+// decodeHash extracts the parameters, salt and hash from an encoded hash.
+// Every error returned matches ErrInvalidHash.
 func decodeHash(encodedHash string) (p *params, salt, hash []byte, err error) {
 	vals := strings.Split(encodedHash, "$")
 	if len(vals) != 6 {
-		return nil, nil, nil, errInvalidHash
+		return nil, nil, nil, ErrInvalidHash
 	}
 
 	var version int
 	_, err = fmt.Sscanf(vals[2], "v=%d", &version)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidHash, err)
 	}
 	if version != argon2.Version {
 		return nil, nil, nil, errIncompatibleVersion
@@ -66,18 +131,18 @@ func decodeHash(encodedHash string) (p *params, salt, hash []byte, err error) {
 	p = &params{}
 	_, err = fmt.Sscanf(vals[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidHash, err)
 	}
 
 	salt, err = base64.RawStdEncoding.DecodeString(vals[4])
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidHash, err)
 	}
 	p.saltLength = uint32(len(salt))
 
 	hash, err = base64.RawStdEncoding.DecodeString(vals[5])
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidHash, err)
 	}
 	p.keyLength = uint32(len(hash))
 
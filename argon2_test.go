@@ -1,7 +1,9 @@
 package authlib
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -27,3 +29,46 @@ func TestHashPassword(t *testing.T) {
 	assert.Empty(t, err, "Error comparing password from quick hash")
 	assert.True(t, match, "Error matching password from quick hash")
 }
+
+func TestHashQueue(t *testing.T) {
+	config := testObject().config
+	config.MaxConcurrentHashes = 1
+	a := New(config)
+
+	// Hold the only slot, so that further hashes have to wait
+	assert.Empty(t, a.hashes.acquire(context.Background()), "Error acquiring free slot")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := a.HashPasswordContext(ctx, HashPasswordOpts{Password: randStr(64)})
+	assert.Equal(t, context.DeadlineExceeded, err, "Hash should have given up waiting for a slot")
+
+	a.hashes.release()
+	hash, err := a.HashPasswordContext(context.Background(), HashPasswordOpts{Password: randStr(64)})
+	assert.Empty(t, err, "Error hashing once the slot was released")
+	assert.NotEmpty(t, hash, "Hash was not returned")
+}
+
+func TestHashCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := testObject().HashPasswordContext(ctx, HashPasswordOpts{Password: randStr(64)})
+	assert.Equal(t, context.Canceled, err, "Hash should not have been computed")
+	_, err = ComparePasswordAndHashContext(ctx, ComparePasswordOpts{Password: randStr(64), EncodedHash: quickHash(randStr(64))})
+	assert.Equal(t, context.Canceled, err, "Password should not have been compared")
+}
+
+func TestDecodeHash(t *testing.T) {
+	params, err := DecodeHash(HashPasswordWithParams(randStr(16), 16, 2))
+	assert.Empty(t, err, "Error decoding hash")
+	assert.Equal(t, HashParams{
+		Memory:      16 * 1024,
+		Iterations:  2,
+		Parallelism: 1,
+		SaltLength:  16,
+		KeyLength:   32,
+	}, params, "Parameters should match those hashed with")
+
+	_, err = DecodeHash("not a hash")
+	assert.ErrorIs(t, err, ErrInvalidHash, "Invalid hash should be rejected")
+}
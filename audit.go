@@ -0,0 +1,172 @@
+package authlib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEventType identifies what happened in an AuditEvent.
+type AuditEventType string
+
+// Types of audit events.
+const (
+	AuditLogin      AuditEventType = "login"       // AttemptLogin was called, whether or not it succeeded
+	AuditLogout     AuditEventType = "logout"      // A session was logged out
+	AuditLogoutAll  AuditEventType = "logout_all"  // Every session of a user was logged out
+	AuditRmbMeLogin AuditEventType = "rmbme_login" // An expired session was resurrected with a remember me cookie
+	AuditTokenReuse AuditEventType = "token_reuse" // A rotated remember me or refresh token was presented again, revoking its family
+	AuditRefresh    AuditEventType = "refresh"     // A refresh token was rejected by a BeforeLogin hook, revoking its family
+
+	AuditSessionRegenerate AuditEventType = "session_regenerate" // A session was moved to a new key by RegenerateSession
+	AuditReauthenticate    AuditEventType = "reauthenticate"     // Reauthenticate was called, whether or not the password matched
+	AuditSessionEvicted    AuditEventType = "session_evicted"    // A session was removed to make room for a new one, as the user had MaxSessionsPerUser or the store held MaxStoredSessions
+)
+
+// Outcomes of audit events, other than those of AuditLogin, which are
+// "success", "wrong_password", "locked" (rejected by a BeforeLogin hook), "session_limit"
+// (rejected as the user has MaxSessionsPerUser) and "error".
+// AuditReauthenticate events may also have "wrong_password", and AuditRmbMeLogin and
+// AuditRefresh events have "locked" when a BeforeLogin hook rejects them.
+const (
+	AuditSuccess = "success"
+	AuditError   = "error"
+	AuditRevoked = "revoked"
+)
+
+// AuditEvent is a record of a change to a user's authentication state.
+type AuditEvent struct {
+	Type      AuditEventType `json:"type"`
+	Time      time.Time      `json:"time"`
+	UserID    string         `json:"userID,omitempty"`
+	SessionID string         `json:"sessionID,omitempty"` // Identifies the login session, without revealing the session key
+	IP        string         `json:"ip,omitempty"`        // Remote address of the request, if any. Proxy headers are not taken into account.
+	UserAgent string         `json:"userAgent,omitempty"`
+	Outcome   string         `json:"outcome"`
+	Reason    string         `json:"reason,omitempty"` // Why the outcome was not a success, if known
+}
+
+// AuditSink receives audit events. Audit is called synchronously,
+// and may be called from several goroutines at once.
+type AuditSink interface {
+	Audit(ctx context.Context, event AuditEvent)
+}
+
+// audit fills in the time and request details of an event, and sends it to the configured sink.
+func (a *Object) audit(ctx context.Context, r *http.Request, event AuditEvent) {
+	if a.config.AuditSink == nil {
+		return
+	}
+	event.Time = a.config.now()
+	if r != nil {
+		event.IP = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			event.IP = host
+		}
+		event.UserAgent = r.UserAgent()
+	}
+	a.config.AuditSink.Audit(ctx, event)
+}
+
+// sessionID derives the ID that a session is identified by in audit events from its store key.
+func sessionID(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// errorReason returns the reason given for an error in audit events.
+func errorReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// JSONLinesSink writes audit events to w as JSON, one event per line.
+type JSONLinesSink struct {
+	mux sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewJSONLinesSink creates a sink writing to w.
+func NewJSONLinesSink(w io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{w: w}
+}
+
+// OpenJSONLinesSink creates a sink appending to the file at path, creating it if needed.
+// The file should be closed with Close once done.
+func OpenJSONLinesSink(path string) (*JSONLinesSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLinesSink(file), nil
+}
+
+// Audit writes the event as a single line.
+func (s *JSONLinesSink) Audit(ctx context.Context, event AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, err = s.w.Write(append(line, '\n')); err != nil && s.err == nil {
+		s.err = err
+	}
+}
+
+// Err returns the first error encountered while writing, if any.
+func (s *JSONLinesSink) Err() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.err
+}
+
+// Close closes the underlying writer, if it can be closed.
+func (s *JSONLinesSink) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if closer, ok := s.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// MemoryAuditSink keeps audit events in memory, for inspecting in tests.
+type MemoryAuditSink struct {
+	mux    sync.Mutex
+	events []AuditEvent
+}
+
+// Audit appends the event to the buffer.
+func (s *MemoryAuditSink) Audit(ctx context.Context, event AuditEvent) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.events = append(s.events, event)
+}
+
+// Events returns a copy of the events received so far, oldest first.
+func (s *MemoryAuditSink) Events() []AuditEvent {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]AuditEvent(nil), s.events...)
+}
+
+// Reset discards the events received so far.
+func (s *MemoryAuditSink) Reset() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.events = nil
+}
@@ -0,0 +1,112 @@
+package authlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditEvents(t *testing.T) {
+	sink := &MemoryAuditSink{}
+	config := testObject().config
+	config.AuditSink = sink
+	a := New(config)
+
+	pw := randStr(64)
+	id := randStr(64)
+	hashedPw := a.HashPassword(HashPasswordOpts{Password: pw})
+	request := httptest.NewRequest(http.MethodPost, "/login", nil)
+	request.RemoteAddr = "203.0.113.7:4321"
+	request.Header.Set("User-Agent", "authlib-test")
+
+	a.AttemptLogin(AttemptLoginOpts{ID: id, ProvidedPassword: randStr(64), PasswordHash: hashedPw, HTTPRequest: request})
+	recorder := httptest.NewRecorder()
+	a.AttemptLogin(AttemptLoginOpts{HTTPWriter: recorder, ID: id, ProvidedPassword: pw, PasswordHash: hashedPw, HTTPRequest: request})
+	a.Logout(HTTPOpts{
+		HTTPWriter:  httptest.NewRecorder(),
+		HTTPRequest: &http.Request{Header: http.Header{"Cookie": recorder.HeaderMap["Set-Cookie"]}},
+	})
+
+	events := sink.Events()
+	if !assert.Len(t, events, 3, "Wrong number of events recorded") {
+		return
+	}
+	assert.Equal(t, AuditLogin, events[0].Type)
+	assert.Equal(t, loginWrongPassword, events[0].Outcome)
+	assert.Empty(t, events[0].SessionID, "Failed login should not have a session")
+
+	assert.Equal(t, AuditLogin, events[1].Type)
+	assert.Equal(t, AuditSuccess, events[1].Outcome)
+	assert.Equal(t, id, events[1].UserID)
+	assert.Equal(t, "203.0.113.7", events[1].IP)
+	assert.Equal(t, "authlib-test", events[1].UserAgent)
+	assert.False(t, events[1].Time.IsZero(), "Time was not recorded")
+
+	assert.Equal(t, AuditLogout, events[2].Type)
+	assert.Equal(t, id, events[2].UserID)
+	assert.NotEmpty(t, events[2].SessionID, "Session ID was not recorded")
+	assert.Equal(t, events[1].SessionID, events[2].SessionID, "Logout should refer to the same session as the login")
+}
+
+func TestAuditRmbMe(t *testing.T) {
+	sink := &MemoryAuditSink{}
+	clock := newTestClock()
+	config := testObject().config
+	config.Clock = clock
+	config.AuditSink = sink
+	a := New(config)
+
+	pw := randStr(64)
+	id := randStr(64)
+	recorder := httptest.NewRecorder()
+	a.AttemptLogin(AttemptLoginOpts{
+		HTTPWriter:       recorder,
+		ID:               id,
+		ProvidedPassword: pw,
+		PasswordHash:     a.HashPassword(HashPasswordOpts{Password: pw}),
+		RmbMe:            true,
+	})
+	stolen := &http.Request{Header: http.Header{"Cookie": recorder.HeaderMap["Set-Cookie"]}}
+	clock.advance(config.IdleTimeout + time.Second)
+	sink.Reset()
+
+	// Resurrect the session, rotating the remember me cookie, then replay the old cookie
+	_, valid, _ := a.CheckLogin(HTTPOpts{HTTPWriter: httptest.NewRecorder(), HTTPRequest: stolen})
+	assert.True(t, valid, "Remember me was not accepted")
+	_, valid, _ = a.CheckLogin(HTTPOpts{HTTPWriter: httptest.NewRecorder(), HTTPRequest: stolen})
+	assert.False(t, valid, "Replayed remember me should not have been accepted")
+
+	events := sink.Events()
+	if !assert.Len(t, events, 2, "Wrong number of events recorded") {
+		return
+	}
+	assert.Equal(t, AuditRmbMeLogin, events[0].Type)
+	assert.Equal(t, id, events[0].UserID)
+	assert.NotEmpty(t, events[0].SessionID, "Session ID was not recorded")
+	assert.Equal(t, AuditTokenReuse, events[1].Type)
+	assert.Equal(t, AuditRevoked, events[1].Outcome)
+	assert.Equal(t, id, events[1].UserID)
+}
+
+func TestJSONLinesSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONLinesSink(&buf)
+	sink.Audit(context.Background(), AuditEvent{Type: AuditLogin, UserID: "1", Outcome: AuditSuccess})
+	sink.Audit(context.Background(), AuditEvent{Type: AuditLogout, UserID: "1", Outcome: AuditSuccess})
+	assert.Empty(t, sink.Err(), "Error writing events")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 2, "Each event should be on its own line") {
+		var event AuditEvent
+		assert.Empty(t, json.Unmarshal([]byte(lines[1]), &event), "Line was not valid JSON")
+		assert.Equal(t, AuditLogout, event.Type)
+		assert.Equal(t, "1", event.UserID)
+	}
+}
@@ -1,10 +1,14 @@
 package authlib
 
 import (
+	"context"
 	"crypto/subtle"
+	"errors"
 	"net/http"
+	"time"
 
-	"github.com/opentracing/opentracing-go"
+	"github.com/kaphos/authlib/internal/testlogin"
+	"go.opentelemetry.io/otel"
 	"golang.org/x/crypto/argon2"
 )
 
@@ -12,65 +16,131 @@ import (
 // used to perform the auth methods, such as a secure cookie object, a key management store,
 // and a database.
 type Object struct {
-	config Config
-	sc     *secureCookie
-	store  storeInterface
-	kms    *keyManagementStore
-	db     *database
+	config  Config
+	sc      *secureCookie
+	store   storeInterface
+	kms     *keyManagementStore
+	db      *database
+	metrics *metrics
+	hashes  hashQueue
+	hooks   *hooks
+
+	spanUserKey []byte // Key that user IDs are hashed with on spans, if HashSpanUserIDs is set
 }
 
 // New creates a Object that can then be used to perform authentication/authorisation methods.
 // Takes in a Config object, highlighting paths for the database & KMS store, as well as parameters
-// for timeouts & argon2 hashing.
+// for timeouts & argon2 hashing. Fields left at their zero value are given defaults.
+// New panics if the config is invalid; call Config.Validate first to check it.
 func New(config Config) *Object {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		panic(err)
+	}
+
 	redisConn := config.RedisConn // convert to empty string if nil
 	redisNamespace := config.RedisNamespace
 
+	store := getStore(redisConn, redisNamespace, config.logger())
 	authObj := Object{
-		config: config,
-		sc:     getSC(config),
-		store:  getStore(redisConn, redisNamespace),
-		kms:    getKMS(config.KMSPath),
-		db:     getDB(config.DBPath),
+		config:  config,
+		sc:      getSC(config),
+		store:   store,
+		kms:     getKMS(config.KMSPath, config.logger()),
+		db:      getDB(config.DBPath),
+		metrics: newMetrics(config.MetricsRegisterer, store),
+		hashes:  newHashQueue(config.MaxConcurrentHashes),
+		hooks:   &hooks{},
+	}
+	if config.HashSpanUserIDs {
+		authObj.spanUserKey = authObj.kms.spanUserKey()
+	}
+	if config.RmbMePruneInterval > 0 {
+		authObj.db.startPruning(config.RmbMePruneInterval, clockOf(config), config.logger())
+	}
+	if store, ok := authObj.store.(*mapStore); ok {
+		if config.SweepInterval > 0 {
+			store.startJanitor(config.SweepInterval, clockOf(config))
+		}
+		if config.MaxStoredSessions > 0 {
+			store.setCapacity(config.MaxStoredSessions, authObj.sessionEvicted)
+		}
+		if config.SnapshotPath != "" {
+			store.startSnapshots(config.SnapshotPath, config.SnapshotInterval, authObj.kms, clockOf(config), config.logger())
+		}
 	}
 	return &authObj
 }
 
+// Close stops the background routines started by New, such as the session
+// sweeper and the remember me pruner, and saves a final snapshot of the sessions
+// if SnapshotPath is set. The store and database are shared by every Object,
+// so Close should only be called when shutting down.
+func (a *Object) Close() {
+	a.store.close()
+	a.db.Close()
+}
+
+// StoreStats returns statistics on the session store, such as the number of
+// sessions held and the number of expired sessions evicted by the sweeper.
+// Redis expires sessions by itself and does not count them, so it reports none.
+func (a *Object) StoreStats() StoreStats {
+	return a.store.stats()
+}
+
 // HashPassword using argon2
 func (a *Object) HashPassword(opts HashPasswordOpts) (hash string) {
-	if opts.SpanContext != nil {
-		span := opentracing.StartSpan("authlib-hashPassword", opentracing.ChildOf(opts.SpanContext))
-		defer span.Finish()
-	}
+	// The background context is never done, so hashing cannot fail
+	hash, _ = a.HashPasswordContext(context.Background(), opts)
+	return
+}
 
-	hashMemory := a.config.HashMemory
-	hashIterations := a.config.HashIterations
-	if hashMemory == 0 {
-		hashMemory = 48
-	}
-	if hashIterations == 0 {
-		hashIterations = 7
+// HashPasswordContext is HashPassword, traced as a child of the span in ctx.
+// If MaxConcurrentHashes is reached, it waits for another hash to finish,
+// returning the context's error if the context is done first.
+func (a *Object) HashPasswordContext(ctx context.Context, opts HashPasswordOpts) (hash string, err error) {
+	_, span := a.startSpan(ctx, "authlib-hashPassword", opts.SpanContext)
+	defer span.end()
+
+	if err = a.hashes.acquire(ctx); err != nil {
+		span.setError(err)
+		return "", err
 	}
-	return argon2Hash(opts.Password, hashMemory, hashIterations)
+	defer a.hashes.release()
+
+	defer a.metrics.observeHash(hashPassword, time.Now())
+	return argon2Hash(opts.Password, a.config.HashMemory, a.config.HashIterations), nil
 }
 
 // ComparePasswordAndHash exposes a helper function to check if a provided password
 // matches a previously generated hash. Check against match to see if password is valid
 // or not. Error is used to indicate if there is any issue with the underlying system.
 func ComparePasswordAndHash(opts ComparePasswordOpts) (match bool, err error) {
-	if opts.SpanContext != nil {
-		span := opentracing.StartSpan("authlib-comparePw", opentracing.ChildOf(opts.SpanContext))
-		defer span.Finish()
+	return ComparePasswordAndHashContext(context.Background(), opts)
+}
+
+// ComparePasswordAndHashContext is ComparePasswordAndHash, traced as a child of the span in ctx
+// using the global OpenTelemetry tracer provider. The password is not checked if the context is done.
+func ComparePasswordAndHashContext(ctx context.Context, opts ComparePasswordOpts) (match bool, err error) {
+	_, span := startSpan(ctx, otel.Tracer(tracerName), "authlib-comparePw", opts.SpanContext, nil)
+	defer span.end()
+
+	if err = ctx.Err(); err == nil {
+		match, err = comparePasswordAndHash(opts.Password, opts.EncodedHash)
 	}
+	span.setError(err)
+	return
+}
 
+func comparePasswordAndHash(password, encodedHash string) (match bool, err error) {
 	// Extract the parameters, salt and derived key from the encoded password hash.
-	p, salt, hash, err := decodeHash(opts.EncodedHash)
+	p, salt, hash, err := decodeHash(encodedHash)
 	if err != nil {
 		return false, err
 	}
 
 	// Derive the key from the other password using the same parameters.
-	otherHash := argon2.IDKey([]byte(opts.Password), salt, p.iterations, p.memory, p.parallelism, p.keyLength)
+	otherHash := argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, p.keyLength)
 
 	// Check that the contents of the hashed passwords are identical. Note
 	// that we are using the subtle.ConstantTimeCompare() function for this
@@ -87,90 +157,268 @@ func ComparePasswordAndHash(opts ComparePasswordOpts) (match bool, err error) {
 // the hash, it will return ok as false. If accepted, it will
 // manage the respective cookies.
 // ok = true: Logged in
-// ok = false, err = nil: Wrong password
-// ok = false, err != nil: An error occurred
+// ok = false, err = ErrWrongPassword: Wrong password
+// ok = false, err = the hook's error: A BeforeLogin hook rejected the login
+// ok = false, err = ErrTooManySessions: The user has MaxSessionsPerUser, with the SessionLimitReject policy
+// ok = false, other err: An error occurred, e.g. ErrInvalidHash or ErrStoreUnavailable
 func (a *Object) AttemptLogin(opts AttemptLoginOpts) (ok bool, err error) {
-	var spanContext opentracing.SpanContext
-	if opts.SpanContext != nil {
-		span := opentracing.StartSpan("authlib-attemptLogin", opentracing.ChildOf(opts.SpanContext))
-		defer span.Finish()
-		spanContext = span.Context()
+	return a.AttemptLoginContext(context.Background(), opts)
+}
+
+// AttemptLoginContext is AttemptLogin, traced as a child of the span in ctx.
+func (a *Object) AttemptLoginContext(ctx context.Context, opts AttemptLoginOpts) (ok bool, err error) {
+	ctx, span := a.startSpan(ctx, "authlib-attemptLogin", opts.SpanContext)
+	defer span.end()
+	span.setUserID(opts.ID)
+
+	return a.login(ctx, span, opts.HTTPRequest, saveLoginOpts{
+		userID: opts.ID,
+		rmbMe:  opts.RmbMe,
+		method: AuthPassword,
+		w:      opts.HTTPWriter,
+	}, func(ctx context.Context) (bool, error) {
+		return a.verifyPassword(ctx, opts.ProvidedPassword, opts.PasswordHash)
+	})
+}
+
+func init() {
+	testlogin.Login = func(object any, w http.ResponseWriter, userID string, rmbMe bool) (bool, error) {
+		return object.(*Object).loginWithoutPassword(context.Background(), loginOpts{HTTPWriter: w, ID: userID, RmbMe: rmbMe})
 	}
+}
 
-	match, err := ComparePasswordAndHash(ComparePasswordOpts{
-		Password:    opts.ProvidedPassword,
-		EncodedHash: opts.PasswordHash,
+// loginWithoutPassword logs a user in without checking a password, for authlibtest.
+// BeforeLogin hooks are still called, and may reject the login.
+// Otherwise it behaves as AttemptLogin with a matching password, recording AuthExternal
+// as the way the user was authenticated.
+func (a *Object) loginWithoutPassword(ctx context.Context, opts loginOpts) (ok bool, err error) {
+	ctx, span := a.startSpan(ctx, "authlib-login", nil)
+	defer span.end()
+	span.setUserID(opts.ID)
+
+	return a.login(ctx, span, nil, saveLoginOpts{
+		userID: opts.ID,
+		rmbMe:  opts.RmbMe,
+		method: AuthExternal,
+		w:      opts.HTTPWriter,
+	}, func(ctx context.Context) (bool, error) {
+		return true, ctx.Err()
 	})
-	if match {
-		// Password matches hash. Perform login.
-		err = a.saveLogin(saveLoginOpts{
-			userID:      opts.ID,
-			rmbMe:       opts.RmbMe,
-			w:           opts.HTTPWriter,
-			spanContext: spanContext,
-		})
+}
+
+// login calls the BeforeLogin hooks, then verify, and saves a login if both accept it.
+// The outcome is recorded in the metrics, span and audit log.
+func (a *Object) login(ctx context.Context, span *span, r *http.Request, opts saveLoginOpts,
+	verify func(ctx context.Context) (bool, error)) (ok bool, err error) {
+	var key string
+	var match, locked bool
+	session := SessionInfo{UserID: opts.userID, Request: r}
+	if err = a.hooks.runBeforeLogin(ctx, session); err != nil {
+		locked = true
+	} else {
+		match, err = verify(ctx)
+	}
+	if match && err == nil {
+		// Login accepted, e.g. the password matches the hash.
+		key, err = a.saveLogin(ctx, opts)
 		ok = (err == nil)
+	} else if err == nil && !locked {
+		err = ErrWrongPassword
+	}
+
+	var outcome string
+	switch {
+	case ok:
+		outcome = loginSuccess
+	case locked:
+		outcome = loginLocked
+	case err == ErrTooManySessions:
+		outcome = loginSessionLimit
+	case err == ErrWrongPassword:
+		outcome = loginWrongPassword
+	default:
+		outcome = loginError
+		a.config.logger().Error("Could not log in", logUserID, opts.userID, logError, err)
+	}
+	a.metrics.login(outcome)
+	span.setOutcome(outcome)
+	if outcome != loginWrongPassword {
+		span.setError(err)
+	}
+	a.audit(ctx, r, AuditEvent{
+		Type:      AuditLogin,
+		UserID:    opts.userID,
+		SessionID: sessionID(key),
+		Outcome:   outcome,
+		Reason:    errorReason(err),
+	})
+	if ok {
+		session.SessionID = sessionID(key)
+		a.hooks.run(ctx, &a.hooks.afterLogin, session)
 	}
 	return
 }
 
 // CheckLogin checks if a user has a valid auth cookie.
 // Called when verifying authentication for an endpoint.
+// If no auth cookie was sent, valid is false and err is nil. Otherwise if the login
+// is not valid, err says why, e.g. ErrSessionExpired, ErrInvalidCookie or ErrTokenReuse.
+// Use CheckSession for more details on the session.
 func (a *Object) CheckLogin(opts HTTPOpts) (userID string, valid bool, err error) {
-	var spanContext opentracing.SpanContext
-	if opts.SpanContext != nil {
-		span := opentracing.StartSpan("authlib-checkLogin", opentracing.ChildOf(opts.SpanContext))
-		defer span.Finish()
-		spanContext = span.Context()
+	return a.CheckLoginContext(contextOf(opts), opts)
+}
+
+// CheckLoginContext is CheckLogin, traced as a child of the span in ctx.
+func (a *Object) CheckLoginContext(ctx context.Context, opts HTTPOpts) (userID string, valid bool, err error) {
+	status, err := a.CheckSessionContext(ctx, opts)
+	return status.UserID, status.Valid, err
+}
+
+// CheckSession is CheckLogin, describing the session in full, e.g. whether it was
+// resurrected from a remember me cookie by this call, and how long it has left.
+func (a *Object) CheckSession(opts HTTPOpts) (status SessionStatus, err error) {
+	return a.CheckSessionContext(contextOf(opts), opts)
+}
+
+// CheckSessionContext is CheckSession, traced as a child of the span in ctx.
+func (a *Object) CheckSessionContext(ctx context.Context, opts HTTPOpts) (status SessionStatus, err error) {
+	status, _, err = a.checkSession(ctx, opts)
+	return
+}
+
+// checkSession is CheckSessionContext, also returning the key of the session.
+func (a *Object) checkSession(ctx context.Context, opts HTTPOpts) (status SessionStatus, key string, err error) {
+	ctx, span := a.startSpan(ctx, "authlib-checkLogin", opts.SpanContext)
+	defer span.end()
+
+	var outcome string
+	status, key, outcome, err = a.checkLogin(ctx, opts)
+	a.metrics.check(outcome)
+	span.setOutcome(outcome)
+	span.setUserID(status.UserID)
+	if outcome == checkError {
+		span.setError(err)
+		a.config.logger().Error("Could not check login", logUserID, status.UserID, logError, err)
 	}
+	return
+}
 
+// checkLogin performs CheckSession, also returning the key of the session
+// and the outcome for instrumentation.
+func (a *Object) checkLogin(ctx context.Context, opts HTTPOpts) (status SessionStatus, key string, outcome string, err error) {
 	cookieObj, err := a.sc.Get(opts.HTTPRequest, "auth")
 	if err != nil {
 		// Check if error was due to cookie not being found
 		if err == http.ErrNoCookie {
-			return "", false, nil
+			return SessionStatus{}, "", checkMissing, nil
 		}
-		return "", false, err
+		return SessionStatus{}, "", checkInvalid, err
 	}
 
 	// Check if key is in our in-mem store
-	userID, valid = a.checkValidCookie(cookieOpts{
-		key:         cookieObj.Key,
-		token:       cookieObj.Token,
-		spanContext: spanContext,
+	session, valid, expired, err := a.checkValidCookie(ctx, cookieOpts{
+		key:   cookieObj.Key,
+		token: cookieObj.Token,
 	})
-	if !valid {
-		// Not valid
-		// Check to see if rmb me cookie is valid
-		userID, err = a.checkRmbMeCookie(opts)
-		if err == nil {
-			err = a.saveLogin(saveLoginOpts{
-				userID:      userID,
-				rmbMe:       true,
-				w:           opts.HTTPWriter,
-				spanContext: spanContext,
-			})
-			if err == nil {
-				valid = true
-			}
+	if err != nil {
+		return SessionStatus{}, "", checkError, err
+	}
+	if valid {
+		a.hooks.run(ctx, &a.hooks.onSessionRefresh, SessionInfo{
+			UserID:    session.UserID,
+			SessionID: sessionID(cookieObj.Key),
+			Request:   opts.HTTPRequest,
+		})
+		return a.sessionStatus(cookieObj.Key, session), cookieObj.Key, checkValid, nil
+	}
+
+	// Not valid
+	// Check to see if rmb me cookie is valid. If so, it is rotated,
+	// and a new login session is created.
+	userID, err := a.checkRmbMeCookie(ctx, opts)
+	if err == http.ErrNoCookie {
+		// No remember me cookie to fall back on, so report why the session was rejected
+		err = errSessionMismatch
+		if expired {
+			err = ErrSessionExpired
 		}
 	}
+	if err == ErrTokenReuse {
+		a.audit(ctx, opts.HTTPRequest, AuditEvent{
+			Type:    AuditTokenReuse,
+			UserID:  userID,
+			Outcome: AuditRevoked,
+			Reason:  "a rotated remember me cookie was presented again",
+		})
+		userID = ""
+	}
+	switch {
+	case ctx.Err() != nil:
+		return SessionStatus{UserID: userID}, "", checkError, err
+	case err == ErrSessionExpired:
+		return SessionStatus{UserID: userID}, "", checkExpired, err
+	case errors.Is(err, ErrStoreUnavailable):
+		return SessionStatus{UserID: userID}, "", checkError, err
+	case err != nil:
+		return SessionStatus{UserID: userID}, "", checkInvalid, err
+	}
 
-	return
+	key, err = a.saveLogin(ctx, saveLoginOpts{
+		userID: userID,
+		method: AuthRmbMe,
+		w:      opts.HTTPWriter,
+	})
+	event := AuditEvent{
+		Type:      AuditRmbMeLogin,
+		UserID:    userID,
+		SessionID: sessionID(key),
+		Outcome:   AuditSuccess,
+	}
+	if err != nil {
+		event.Outcome, event.Reason = AuditError, errorReason(err)
+	}
+	a.audit(ctx, opts.HTTPRequest, event)
+	if err != nil {
+		return SessionStatus{UserID: userID}, "", checkError, err
+	}
+	a.hooks.run(ctx, &a.hooks.onRmbMeUse, SessionInfo{
+		UserID:    userID,
+		SessionID: event.SessionID,
+		Request:   opts.HTTPRequest,
+	})
+	status = a.sessionStatus(key, a.newSessionValue("", userID, AuthRmbMe))
+	status.Resurrected = true
+	return status, key, checkRmbMe, nil
 }
 
 // Logout clears out the relevant cookies on the user side,
 // while also removing the respective data on the server side.
 func (a *Object) Logout(opts HTTPOpts) {
-	if opts.SpanContext != nil {
-		span := opentracing.StartSpan("authlib-logout", opentracing.ChildOf(opts.SpanContext))
-		defer span.Finish()
-	}
+	a.LogoutContext(contextOf(opts), opts)
+}
 
+// LogoutContext is Logout, traced as a child of the span in ctx.
+// The cookies are always cleared, but the server side data is left
+// to expire by itself if the context is done before it can be removed.
+func (a *Object) LogoutContext(ctx context.Context, opts HTTPOpts) {
+	ctx, span := a.startSpan(ctx, "authlib-logout", opts.SpanContext)
+	defer span.end()
+
+	var event AuditEvent
+	var loggedIn bool
 	cookieObj, err := a.sc.Get(opts.HTTPRequest, "auth")
 	if err == nil {
 		// Remove item from in-mem storage
-		a.store.unset(cookieObj.Key)
+		loggedIn = true
+		event.SessionID = sessionID(cookieObj.Key)
+		var value storeValue
+		if value, _, err = a.store.get(ctx, cookieObj.Key); err == nil {
+			event.UserID = value.UserID
+			err = a.store.unset(ctx, cookieObj.Key)
+		}
+		err = storeError("remove session", err)
+		event.Reason = errorReason(err)
+		span.setError(err)
 	}
 
 	// Remove cookie from the user side
@@ -179,32 +427,71 @@ func (a *Object) Logout(opts HTTPOpts) {
 	// Clear remember me also, if it exists
 	cookieObj, err = a.sc.Get(opts.HTTPRequest, "rmbme")
 	if err == nil {
+		loggedIn = true
 		a.sc.Set(opts.HTTPWriter, "rmbme", cookieValue{}, -1)
-		a.db.RemoveSingle(cookieObj.Key)
+		var entry Store
+		entry, err = a.revokeRmbMe(ctx, cookieObj.Key)
+		if event.UserID == "" {
+			event.UserID = entry.UserID
+		}
+		if event.Reason == "" {
+			event.Reason = errorReason(err)
+		}
+		span.setError(err)
+	}
+
+	if loggedIn {
+		event.Type, event.Outcome = AuditLogout, AuditSuccess
+		if event.Reason != "" {
+			event.Outcome = AuditError
+		}
+		a.audit(ctx, opts.HTTPRequest, event)
+		a.hooks.run(ctx, &a.hooks.onLogout, SessionInfo{
+			UserID:    event.UserID,
+			SessionID: event.SessionID,
+			Request:   opts.HTTPRequest,
+		})
 	}
 }
 
 // LogoutAll removes all stored tokens in the database, and also
 // invalidates the current login session
 func (a *Object) LogoutAll(opts HTTPOpts) {
-	var spanContext opentracing.SpanContext
-	if opts.SpanContext != nil {
-		span := opentracing.StartSpan("authlib-logoutAll", opentracing.ChildOf(opts.SpanContext))
-		defer span.Finish()
-		spanContext = span.Context()
-	}
+	a.LogoutAllContext(contextOf(opts), opts)
+}
+
+// LogoutAllContext is LogoutAll, traced as a child of the span in ctx.
+func (a *Object) LogoutAllContext(ctx context.Context, opts HTTPOpts) {
+	ctx, span := a.startSpan(ctx, "authlib-logoutAll", opts.SpanContext)
+	defer span.end()
 
 	cookieObj, err := a.sc.Get(opts.HTTPRequest, "auth")
 	if err == nil {
-		userID, valid := a.checkValidCookie(cookieOpts{
-			key:         cookieObj.Key,
-			token:       cookieObj.Token,
-			spanContext: spanContext,
+		session, valid, _, err := a.checkValidCookie(ctx, cookieOpts{
+			key:   cookieObj.Key,
+			token: cookieObj.Token,
 		})
+		userID := session.UserID
 		if valid {
-			a.db.RemoveAll(userID)
-			a.store.unsetAll(userID)
+			span.setUserID(userID)
+			if err = storeError("remove remember me tokens", a.db.RemoveAll(ctx, userID)); err == nil {
+				err = storeError("remove sessions", a.store.unsetAll(ctx, userID))
+			}
+			event := AuditEvent{
+				Type:      AuditLogoutAll,
+				UserID:    userID,
+				SessionID: sessionID(cookieObj.Key),
+				Outcome:   AuditSuccess,
+			}
+			if err != nil {
+				event.Outcome, event.Reason = AuditError, errorReason(err)
+			}
+			a.audit(ctx, opts.HTTPRequest, event)
 		}
+		span.setError(err)
 	}
-	a.Logout(opts)
+
+	// The span has been passed on through ctx already
+	opts.SpanContext = nil
+	a.LogoutContext(ctx, opts)
 }
@@ -1,10 +1,12 @@
 package authlib
 
 import (
+	"context"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -29,9 +31,30 @@ func getCookie(recorder *httptest.ResponseRecorder, cookieName string) (*http.Co
 	return request.Cookie(cookieName)
 }
 
+// testClock is a Clock that only moves when advanced.
+type testClock struct {
+	mux sync.Mutex
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Now()}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.now = c.now.Add(d)
+}
+
 func testObject() *Object {
 	config := Config{
-		RedisConn:      "localhost:6379",
 		RedisNamespace: randStr(32),
 		KMSPath:        testKMSConfigPath,
 		DBPath:         testDBPath,
@@ -87,13 +110,32 @@ func TestWrongAttemptLogin(t *testing.T) {
 		RmbMe:            false,
 	})
 
-	assert.Empty(t, err, "An error occurred while logging in")
+	assert.Equal(t, ErrWrongPassword, err, "Wrong password was not reported")
 	assert.False(t, ok, "Login should not have been accepted")
 
 	_, err = getCookie(recorder, "auth")
 	assert.NotEmpty(t, err, "Cookie should not have been set")
 }
 
+func TestLoginWithoutPassword(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	a := testObject()
+	id := randStr(64)
+
+	ok, err := a.loginWithoutPassword(context.Background(), loginOpts{HTTPWriter: recorder, ID: id, RmbMe: true})
+	assert.True(t, ok, "Login was not accepted")
+	assert.Empty(t, err, "An error occurred while logging in")
+
+	request := &http.Request{Header: http.Header{"Cookie": recorder.Result().Header["Set-Cookie"]}}
+	userID, valid, err := a.CheckLogin(HTTPOpts{HTTPWriter: httptest.NewRecorder(), HTTPRequest: request})
+	assert.True(t, valid, "Session from loginWithoutPassword was not accepted")
+	assert.Equal(t, id, userID, "Session belongs to the wrong user")
+	assert.Empty(t, err, "An error occurred while checking the login")
+
+	_, err = getCookie(recorder, "rmbme")
+	assert.Empty(t, err, "Remember me cookie was not set")
+}
+
 func TestFunctioningCheckLogin(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	id := randStr(64)
@@ -196,7 +238,6 @@ func TestLogout(t *testing.T) {
 func TestRmbMeWorkflow(t *testing.T) {
 	// Attempt login
 	config := Config{
-		RedisConn:      "localhost:6379",
 		RedisNamespace: randStr(32),
 		KMSPath:        testKMSConfigPath,
 		DBPath:         testDBPath,
@@ -280,7 +321,6 @@ func TestLogoutFromAll(t *testing.T) {
 func TestExpiredRmbMeWorkflow(t *testing.T) {
 	// Attempt login
 	config := Config{
-		RedisConn:      "localhost:6379",
 		RedisNamespace: randStr(32),
 		KMSPath:        testKMSConfigPath,
 		DBPath:         testDBPath,
@@ -319,3 +359,136 @@ func TestExpiredRmbMeWorkflow(t *testing.T) {
 	assert.Empty(t, userID, "User ID should be empty")
 	assert.False(t, valid, "Incorrectly reported login as valid")
 }
+
+func TestTimeoutsWithClock(t *testing.T) {
+	clock := newTestClock()
+	config := testObject().config
+	config.Clock = clock
+	config.IdleTimeout = time.Hour
+	config.ForcedTimeout = time.Hour * 3
+	config.RmbMeTimeout = time.Hour * 24
+	testObj := New(config)
+
+	login := func(rmbMe bool) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		pw := randStr(64)
+		ok, err := testObj.AttemptLogin(AttemptLoginOpts{
+			HTTPWriter:       recorder,
+			ID:               randStr(64),
+			ProvidedPassword: pw,
+			PasswordHash:     testObj.HashPassword(HashPasswordOpts{Password: pw}),
+			RmbMe:            rmbMe,
+		})
+		assert.True(t, ok, "Login was not accepted")
+		assert.Empty(t, err, "An error occurred while logging in")
+		return recorder
+	}
+	check := func(recorder *httptest.ResponseRecorder) bool {
+		_, valid, _ := testObj.CheckLogin(HTTPOpts{
+			HTTPWriter:  httptest.NewRecorder(),
+			HTTPRequest: &http.Request{Header: http.Header{"Cookie": recorder.HeaderMap["Set-Cookie"]}},
+		})
+		return valid
+	}
+
+	// Idle timeout
+	recorder := login(false)
+	clock.advance(time.Minute * 59)
+	assert.True(t, check(recorder), "Session should still be valid before the idle timeout")
+	clock.advance(time.Minute * 61)
+	assert.False(t, check(recorder), "Session should have expired after the idle timeout")
+
+	// Forced timeout, even if the session is kept active
+	recorder = login(false)
+	for i := 0; i < 5; i++ {
+		clock.advance(time.Minute * 30)
+		assert.True(t, check(recorder), "Active session should still be valid")
+	}
+	clock.advance(time.Minute * 31)
+	assert.False(t, check(recorder), "Session should have expired after the forced timeout")
+
+	// Remember me outlives the session, until it expires itself
+	recorder = login(true)
+	clock.advance(time.Minute * 61)
+	assert.True(t, check(recorder), "Session should have been resurrected by remember me")
+
+	recorder = login(true)
+	clock.advance(config.RmbMeTimeout + time.Minute)
+	assert.False(t, check(recorder), "Remember me should have expired")
+}
+
+func TestCancelledCheckLogin(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	pw := randStr(64)
+	a := testObject()
+	ok, err := a.AttemptLogin(AttemptLoginOpts{
+		HTTPWriter:       recorder,
+		ID:               randStr(64),
+		ProvidedPassword: pw,
+		PasswordHash:     a.HashPassword(HashPasswordOpts{Password: pw}),
+	})
+	assert.True(t, ok, "Login was not accepted")
+	assert.Empty(t, err, "An error occurred while logging in")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opts := HTTPOpts{
+		HTTPWriter:  httptest.NewRecorder(),
+		HTTPRequest: (&http.Request{Header: http.Header{"Cookie": recorder.HeaderMap["Set-Cookie"]}}).WithContext(ctx),
+	}
+	_, valid, err := a.CheckLogin(opts)
+	assert.False(t, valid, "Login should not have been checked once cancelled")
+	assert.Equal(t, context.Canceled, err, "Cancellation was not reported")
+
+	// The session is left intact
+	opts.HTTPRequest = opts.HTTPRequest.WithContext(context.Background())
+	_, valid, err = a.CheckLogin(opts)
+	assert.Empty(t, err, "Error checking login")
+	assert.True(t, valid, "Session should still be valid")
+}
+
+func TestCheckSession(t *testing.T) {
+	clock := newTestClock()
+	config := testObject().config
+	config.Clock = clock
+	config.IdleTimeout = time.Hour
+	config.ForcedTimeout = time.Hour * 3
+	config.RmbMeTimeout = time.Hour * 24
+	testObj := New(config)
+
+	pw := randStr(16)
+	login := httptest.NewRecorder()
+	ok, _ := testObj.AttemptLogin(AttemptLoginOpts{
+		HTTPWriter:       login,
+		ID:               randStr(64),
+		ProvidedPassword: pw,
+		PasswordHash:     quickHash(pw),
+		RmbMe:            true,
+	})
+	assert.True(t, ok, "Login was not accepted")
+	loginTime := clock.Now()
+	check := func() SessionStatus {
+		status, err := testObj.CheckSession(HTTPOpts{
+			HTTPWriter:  httptest.NewRecorder(),
+			HTTPRequest: &http.Request{Header: http.Header{"Cookie": login.Result().Header["Set-Cookie"]}},
+		})
+		assert.Empty(t, err, "Error checking session")
+		return status
+	}
+
+	clock.advance(time.Minute * 10)
+	status := check()
+	assert.True(t, status.Valid, "Session should be valid")
+	assert.False(t, status.Resurrected, "Session should not have been resurrected")
+	assert.Equal(t, AuthPassword, status.Origin, "Session was established by password")
+	assert.Equal(t, loginTime, status.AuthTime, "Wrong time of authentication")
+	assert.Equal(t, time.Hour, status.IdleRemaining, "Idle timeout should be extended by the check")
+	assert.Equal(t, time.Hour*3-time.Minute*10, status.AbsoluteRemaining, "Wrong time left until the forced timeout")
+
+	clock.advance(time.Minute * 61)
+	status = check()
+	assert.True(t, status.Valid, "Session should be resurrected by remember me")
+	assert.True(t, status.Resurrected, "Session should be reported as resurrected")
+	assert.Equal(t, AuthRmbMe, status.Origin, "Session was established by remember me")
+	assert.Equal(t, time.Hour*3, status.AbsoluteRemaining, "Resurrected session should have its full lifetime")
+}
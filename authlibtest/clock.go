@@ -0,0 +1,41 @@
+// Package authlibtest provides helpers for testing code that uses authlib.
+package authlibtest
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a fake clock that can be set as Config.Clock. Its time only moves
+// when advanced, so idle, forced and "Remember Me" expiry can be tested
+// without sleeping.
+type Clock struct {
+	mux sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a Clock set to the given time.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the clock's current time.
+func (c *Clock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by the given duration.
+func (c *Clock) Advance(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to the given time.
+func (c *Clock) Set(now time.Time) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.now = now
+}
@@ -0,0 +1,23 @@
+package authlibtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kaphos/authlib"
+	"github.com/stretchr/testify/assert"
+)
+
+var _ authlib.Clock = (*Clock)(nil)
+
+func TestClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewClock(start)
+	assert.Equal(t, start, clock.Now(), "Clock should start at the given time")
+
+	clock.Advance(time.Hour)
+	assert.Equal(t, start.Add(time.Hour), clock.Now(), "Clock was not advanced")
+
+	clock.Set(start)
+	assert.Equal(t, start, clock.Now(), "Clock was not set")
+}
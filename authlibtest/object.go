@@ -0,0 +1,158 @@
+package authlibtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kaphos/authlib"
+	"github.com/kaphos/authlib/internal/testlogin"
+)
+
+// Object wraps an *authlib.Object set up for tests, along with the fake
+// clock and audit sink it was given.
+type Object struct {
+	*authlib.Object
+	Clock *Clock                   // Nil if the config came with a clock of another type
+	Audit *authlib.MemoryAuditSink // Nil if the config came with its own sink
+
+	t testing.TB
+}
+
+// NewObject creates an Object for tests. Unless set in config, it hashes with the
+// cheapest argon2 parameters, keeps sessions in memory, generates keys that are
+// never saved, reads time from a Clock starting at the current time, and audits
+// to a MemoryAuditSink. Note that the session store and keys are shared by every
+// Object in the process, so they are set up by whichever is created first.
+func NewObject(t testing.TB, config authlib.Config) *Object {
+	t.Helper()
+	o := &Object{t: t}
+	if config.HashMemory == 0 {
+		config.HashMemory = 1
+	}
+	if config.HashIterations == 0 {
+		config.HashIterations = 1
+	}
+	if config.Clock == nil {
+		config.Clock = NewClock(time.Now())
+	}
+	o.Clock, _ = config.Clock.(*Clock)
+	if config.AuditSink == nil {
+		config.AuditSink = &authlib.MemoryAuditSink{}
+	}
+	o.Audit, _ = config.AuditSink.(*authlib.MemoryAuditSink)
+	if err := config.Validate(); err != nil {
+		t.Fatalf("authlibtest: %v", err)
+	}
+	o.Object = authlib.New(config)
+	return o
+}
+
+// Session holds the cookies of a logged in user, as a browser would.
+type Session struct {
+	UserID  string
+	Cookies []*http.Cookie
+}
+
+// LoginAs logs the user in without a password, returning their session.
+func (o *Object) LoginAs(userID string) *Session {
+	o.t.Helper()
+	return o.login(userID, false)
+}
+
+// LoginAsRmbMe is LoginAs, also setting a 'Remember Me' cookie.
+func (o *Object) LoginAsRmbMe(userID string) *Session {
+	o.t.Helper()
+	return o.login(userID, true)
+}
+
+func (o *Object) login(userID string, rmbMe bool) *Session {
+	o.t.Helper()
+	recorder := httptest.NewRecorder()
+	ok, err := testlogin.Login(o.Object, recorder, userID, rmbMe)
+	if !ok {
+		o.t.Fatalf("authlibtest: could not log in as %q: %v", userID, err)
+	}
+	session := &Session{UserID: userID}
+	session.update(recorder.Result().Cookies())
+	return session
+}
+
+// Cookie returns the session's cookie with the given name, or nil if it has none.
+func (s *Session) Cookie(name string) *http.Cookie {
+	for _, cookie := range s.Cookies {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// AddTo adds the session's cookies to r, returning it for chaining.
+func (s *Session) AddTo(r *http.Request) *http.Request {
+	for _, cookie := range s.Cookies {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+// Request returns a new request to target carrying the session's cookies.
+func (s *Session) Request(method, target string) *http.Request {
+	return s.AddTo(httptest.NewRequest(method, target, nil))
+}
+
+// Update applies the cookies set in a response to the session, as a browser would,
+// e.g. once a handler has logged the user out, or resurrected their session.
+func (s *Session) Update(w *httptest.ResponseRecorder) {
+	s.update(w.Result().Cookies())
+}
+
+func (s *Session) update(set []*http.Cookie) {
+	for _, cookie := range set {
+		kept := s.Cookies[:0]
+		for _, existing := range s.Cookies {
+			if existing.Name != cookie.Name {
+				kept = append(kept, existing)
+			}
+		}
+		s.Cookies = kept
+		if cookie.MaxAge >= 0 && cookie.Value != "" {
+			s.Cookies = append(s.Cookies, cookie)
+		}
+	}
+}
+
+// Check calls CheckLogin with the session's cookies, applying any cookies it sets.
+func (o *Object) Check(s *Session) (userID string, valid bool, err error) {
+	recorder := httptest.NewRecorder()
+	userID, valid, err = o.CheckLogin(authlib.HTTPOpts{
+		HTTPWriter:  recorder,
+		HTTPRequest: s.Request(http.MethodGet, "/"),
+	})
+	s.Update(recorder)
+	return
+}
+
+// AssertLoggedIn reports an error if the session is not accepted by CheckLogin
+// as belonging to its user.
+func (o *Object) AssertLoggedIn(s *Session) bool {
+	o.t.Helper()
+	userID, valid, err := o.Check(s)
+	if !valid || userID != s.UserID {
+		o.t.Errorf("authlibtest: expected session of %q to be logged in, got user %q, valid %v, error %v", s.UserID, userID, valid, err)
+		return false
+	}
+	return true
+}
+
+// AssertSessionRevoked reports an error if the session is still accepted by CheckLogin,
+// including through its 'Remember Me' cookie, e.g. after logging out.
+func (o *Object) AssertSessionRevoked(s *Session) bool {
+	o.t.Helper()
+	if userID, valid, _ := o.Check(s); valid {
+		o.t.Errorf("authlibtest: expected session of %q to be revoked, but it is logged in as %q", s.UserID, userID)
+		return false
+	}
+	return true
+}
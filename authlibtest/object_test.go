@@ -0,0 +1,63 @@
+package authlibtest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kaphos/authlib"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingTB records the errors reported to it, to test failing assertions.
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestLoginAs(t *testing.T) {
+	o := NewObject(t, authlib.Config{})
+	session := o.LoginAs("alice")
+	assert.NotNil(t, session.Cookie("auth"), "Auth cookie should be set")
+	assert.Nil(t, session.Cookie("rmbme"), "Remember me cookie should not be set")
+	o.AssertLoggedIn(session)
+
+	recorder := httptest.NewRecorder()
+	o.Logout(authlib.HTTPOpts{HTTPWriter: recorder, HTTPRequest: session.Request(http.MethodPost, "/logout")})
+	o.AssertSessionRevoked(session) // Still holding the cookies from before the logout
+
+	events := o.Audit.Events()
+	assert.Equal(t, authlib.AuditLogin, events[0].Type, "Login should be audited")
+	assert.Equal(t, authlib.AuditLogout, events[len(events)-1].Type, "Logout should be audited")
+}
+
+func TestLoginAsExpiry(t *testing.T) {
+	o := NewObject(t, authlib.Config{IdleTimeout: time.Minute})
+	session := o.LoginAs("bob")
+	rmbMe := o.LoginAsRmbMe("carol")
+
+	o.Clock.Advance(2 * time.Minute)
+	o.AssertSessionRevoked(session)
+	o.AssertLoggedIn(rmbMe) // Resurrected through the remember me cookie
+	o.AssertLoggedIn(rmbMe) // With the new cookies applied
+}
+
+func TestAssertionFailures(t *testing.T) {
+	o := NewObject(t, authlib.Config{})
+	session := o.LoginAs("dave")
+
+	tb := &recordingTB{TB: t}
+	o.t = tb
+	assert.False(t, o.AssertSessionRevoked(session), "Logged in session should not be revoked")
+	o.Clock.Advance(2 * time.Hour)
+	assert.False(t, o.AssertLoggedIn(session), "Expired session should not be logged in")
+	assert.Len(t, tb.errors, 2, "Both failures should be reported")
+}
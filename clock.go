@@ -0,0 +1,29 @@
+package authlib
+
+import "time"
+
+// Clock is the source of the current time for all time-based logic,
+// such as session, cookie and token expiry. It can be replaced in
+// Config to control time in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+// now returns the current time according to the configured clock.
+func (c Config) now() time.Time {
+	return clockOf(c).Now()
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// clockOf returns the configured clock, or the system clock if none is set.
+func clockOf(config Config) Clock {
+	if config.Clock == nil {
+		return systemClock{}
+	}
+	return config.Clock
+}
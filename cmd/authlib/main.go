@@ -0,0 +1,219 @@
+// Command authlib manages authlib's keys and password hashes outside of a running app.
+//
+// Usage:
+//
+//	authlib kms generate -file auth.keys
+//	authlib kms rotate -file auth.keys [-keep 1]
+//	authlib hash [-memory 48] [-iterations 7] < password
+//	authlib verify -hash '$argon2id$...' < password
+//	authlib inspect-hash '$argon2id$...'
+//	authlib decode-cookie -kms auth.keys [-name auth] <value>
+//
+// Passwords are read from the first line of stdin, so that they are not kept
+// in the shell's history.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kaphos/authlib"
+)
+
+const usage = `Usage: authlib <command> [flags]
+
+Commands:
+  kms generate    Generate a new KMS file
+  kms rotate      Replace the keys in a KMS file, keeping the previous keys
+  hash            Hash a password read from stdin
+  verify          Check a password read from stdin against a hash
+  inspect-hash    Print the parameters of a hash
+  decode-cookie   Decode an auth, rmbme or refresh cookie with a KMS file
+`
+
+// errNoMatch is returned by verify when the password does not match, to exit with a non-zero status.
+var errNoMatch = errors.New("password does not match")
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "authlib:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run runs the command given by args.
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stdout, usage)
+		return flag.ErrHelp
+	}
+	switch args[0] {
+	case "kms":
+		return runKMS(args[1:], stdout)
+	case "hash":
+		return runHash(args[1:], stdin, stdout)
+	case "verify":
+		return runVerify(args[1:], stdin, stdout)
+	case "inspect-hash":
+		return runInspectHash(args[1:], stdout)
+	case "decode-cookie":
+		return runDecodeCookie(args[1:], stdout)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q, run \"authlib help\" for a list", args[0])
+}
+
+func runKMS(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("kms needs a subcommand, generate or rotate")
+	}
+	flags := flag.NewFlagSet("kms "+args[0], flag.ContinueOnError)
+	file := flags.String("file", "", "path of the KMS file, as in Config.KMSPath")
+	keep := 0
+	if args[0] == "rotate" {
+		flags.IntVar(&keep, "keep", 1, "number of previous sets of keys to keep, so that existing sessions and tokens stay valid")
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+
+	switch args[0] {
+	case "generate":
+		if err := authlib.GenerateKMSFile(*file); err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, "Generated keys in", *file)
+	case "rotate":
+		if err := authlib.RotateKMSFile(*file, keep); err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, "Rotated keys in", *file, "- restart the app to use them")
+	default:
+		return fmt.Errorf("unknown kms subcommand %q, expected generate or rotate", args[0])
+	}
+	return nil
+}
+
+func runHash(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("hash", flag.ContinueOnError)
+	memory := flags.Uint("memory", 48, "memory to use, in megabytes")
+	iterations := flags.Uint("iterations", 7, "number of iterations")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *memory == 0 || *iterations == 0 {
+		return errors.New("-memory and -iterations must be positive")
+	}
+
+	password, err := readPassword(stdin)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, authlib.HashPasswordWithParams(password, uint32(*memory), uint32(*iterations)))
+	return nil
+}
+
+func runVerify(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	hash := flags.String("hash", "", "encoded hash to check against")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *hash == "" {
+		return errors.New("-hash is required")
+	}
+
+	password, err := readPassword(stdin)
+	if err != nil {
+		return err
+	}
+	match, err := authlib.ComparePasswordAndHash(authlib.ComparePasswordOpts{
+		Password:    password,
+		EncodedHash: *hash,
+	})
+	if err != nil {
+		return err
+	}
+	if !match {
+		return errNoMatch
+	}
+	fmt.Fprintln(stdout, "Password matches")
+	return nil
+}
+
+func runInspectHash(args []string, stdout io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("inspect-hash takes a single hash")
+	}
+	params, err := authlib.DecodeHash(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "algorithm:   argon2id\n")
+	fmt.Fprintf(stdout, "memory:      %d KiB\n", params.Memory)
+	fmt.Fprintf(stdout, "iterations:  %d\n", params.Iterations)
+	fmt.Fprintf(stdout, "parallelism: %d\n", params.Parallelism)
+	fmt.Fprintf(stdout, "salt length: %d bytes\n", params.SaltLength)
+	fmt.Fprintf(stdout, "key length:  %d bytes\n", params.KeyLength)
+	return nil
+}
+
+func runDecodeCookie(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("decode-cookie", flag.ContinueOnError)
+	kmsPath := flags.String("kms", "", "path of the KMS file the cookie was encoded with")
+	name := flags.String("name", "auth", "name of the cookie: auth, rmbme or refresh")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *kmsPath == "" {
+		return errors.New("-kms is required")
+	}
+	if flags.NArg() != 1 {
+		return errors.New("decode-cookie takes a single cookie value")
+	}
+
+	info, err := authlib.DecodeCookie(*kmsPath, *name, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "name:       %s\n", info.Name)
+	if info.UserID != "" {
+		fmt.Fprintf(stdout, "user ID:    %s\n", info.UserID)
+		fmt.Fprintf(stdout, "session ID: %s\n", info.SessionID)
+	}
+	expired := ""
+	if info.Expires.Before(time.Now()) {
+		expired = " (expired)"
+	}
+	fmt.Fprintf(stdout, "expires:    %s%s\n", info.Expires.Format(time.RFC3339), expired)
+	if info.Previous {
+		fmt.Fprintln(stdout, "keys:       previous, from before the last rotation")
+	}
+	return nil
+}
+
+// readPassword reads the first line of r.
+func readPassword(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("no password given on stdin")
+	}
+	return line, nil
+}
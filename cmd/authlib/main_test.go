@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kaphos/authlib"
+	"github.com/kaphos/authlib/authlibtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKMSCommands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	var out bytes.Buffer
+	assert.Empty(t, run([]string{"kms", "generate", "-file", path}, nil, &out), "Error generating key file")
+	assert.Error(t, run([]string{"kms", "generate", "-file", path}, nil, &out), "Existing key file should not be overwritten")
+	assert.Empty(t, run([]string{"kms", "rotate", "-file", path, "-keep", "2"}, nil, &out), "Error rotating key file")
+	assert.Error(t, run([]string{"kms", "rotate"}, nil, &out), "Missing file should be rejected")
+}
+
+func TestHashCommands(t *testing.T) {
+	var out bytes.Buffer
+	err := run([]string{"hash", "-memory", "1", "-iterations", "1"}, strings.NewReader("hunter2\n"), &out)
+	assert.Empty(t, err, "Error hashing password")
+	hash := strings.TrimSpace(out.String())
+
+	out.Reset()
+	assert.Empty(t, run([]string{"verify", "-hash", hash}, strings.NewReader("hunter2\n"), &out), "Password should match")
+	assert.ErrorIs(t, run([]string{"verify", "-hash", hash}, strings.NewReader("hunter3\n"), &out), errNoMatch, "Wrong password should not match")
+
+	out.Reset()
+	assert.Empty(t, run([]string{"inspect-hash", hash}, nil, &out), "Error inspecting hash")
+	assert.Contains(t, out.String(), "memory:      1024 KiB", "Memory should be printed")
+	assert.Contains(t, out.String(), "iterations:  1", "Iterations should be printed")
+}
+
+// The KMS is loaded once per process, so every cookie is encoded with this file.
+var (
+	cookieKMSPath string
+	cookieObject  *authlibtest.Object
+	cookieOnce    sync.Once
+)
+
+// cookieKMS returns a KMS file, generated through the CLI, and an Object
+// encoding cookies with it.
+func cookieKMS(t *testing.T) (string, *authlibtest.Object) {
+	cookieOnce.Do(func() {
+		cookieKMSPath = filepath.Join(os.TempDir(), fmt.Sprintf("authlib-cli-test-%d.keys", os.Getpid()))
+		if err := run([]string{"kms", "generate", "-file", cookieKMSPath}, nil, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		cookieObject = authlibtest.NewObject(t, authlib.Config{KMSPath: cookieKMSPath})
+	})
+	return cookieKMSPath, cookieObject
+}
+
+func TestDecodeCookieCommand(t *testing.T) {
+	path, o := cookieKMS(t)
+	session := o.LoginAsRmbMe("some-user")
+	auth, rmbMe := session.Cookie("auth"), session.Cookie("rmbme")
+
+	var out bytes.Buffer
+	assert.Empty(t, run([]string{"decode-cookie", "-kms", path, auth.Value}, nil, &out), "Error decoding auth cookie")
+	assert.Contains(t, out.String(), "name:       auth", "Name should be printed")
+	assert.Contains(t, out.String(), "user ID:    some-user", "User ID should be printed")
+	assert.Contains(t, out.String(), "session ID: ", "Session ID should be printed")
+	assert.NotContains(t, out.String(), "(expired)", "Fresh cookie should not be reported as expired")
+	assert.NotContains(t, out.String(), "previous", "Cookie should use the current keys")
+
+	out.Reset()
+	assert.Empty(t, run([]string{"decode-cookie", "-kms", path, "-name", "rmbme", rmbMe.Value}, nil, &out), "Error decoding rmbme cookie")
+	assert.Contains(t, out.String(), "name:       rmbme", "Name should be printed")
+	assert.NotContains(t, out.String(), "user ID:", "Rmbme cookie does not carry a user ID")
+
+	// Cookies from before a rotation are reported as such
+	rotated := filepath.Join(t.TempDir(), "keys")
+	contents, _ := os.ReadFile(path)
+	os.WriteFile(rotated, contents, 0600)
+	assert.Empty(t, run([]string{"kms", "rotate", "-file", rotated}, nil, &out), "Error rotating key file")
+	out.Reset()
+	assert.Empty(t, run([]string{"decode-cookie", "-kms", rotated, auth.Value}, nil, &out), "Error decoding cookie after rotation")
+	assert.Contains(t, out.String(), "keys:       previous", "Previous keys should be reported")
+}
+
+func TestDecodeCookieCommandTampered(t *testing.T) {
+	path, o := cookieKMS(t)
+	value := o.LoginAs("some-user").Cookie("auth").Value
+
+	var out bytes.Buffer
+	err := run([]string{"decode-cookie", "-kms", path, value[:len(value)-2] + "xx"}, nil, &out)
+	assert.ErrorIs(t, err, authlib.ErrInvalidCookie, "Tampered cookie should be rejected")
+	assert.Empty(t, out.String(), "Nothing should be printed for a tampered cookie")
+
+	err = run([]string{"decode-cookie", "-kms", path, "-name", "rmbme", value}, nil, &out)
+	assert.ErrorIs(t, err, authlib.ErrInvalidCookie, "Cookie decoded under another name should be rejected")
+
+	err = run([]string{"decode-cookie", "-kms", filepath.Join(t.TempDir(), "other"), value}, nil, &out)
+	assert.Error(t, err, "Missing KMS file should be rejected")
+	assert.Error(t, run([]string{"decode-cookie", value}, nil, &out), "-kms should be required")
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if cookieKMSPath != "" {
+		os.Remove(cookieKMSPath)
+	}
+	os.Exit(code)
+}
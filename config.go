@@ -1,21 +1,204 @@
 package authlib
 
 import (
+	"fmt"
+	"strings"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Config contains the package parameters that can be tuned
+// Config contains the package parameters that can be tuned.
+// The config tags give the keys used by LoadConfig.
 type Config struct {
-	RedisConn      string        // Connection string for Redis, if applicable. Leaving it blank will cause it to default to use in-mem map storage
-	RedisNamespace string        // Namespace to use to prefix keys in Redis
-	KMSPath        string        // Where the generated secure cookie keys should be stored
-	DBPath         string        // Where the sqlite3 database should be stored (for rmb me)
-	IdleTimeout    time.Duration // How long they can be idle before they're logged out
-	ForcedTimeout  time.Duration // How long the session can persist before they're asked to log in again
-	RmbMeTimeout   time.Duration // How long the "Remember Me" token is valid for
-	HashMemory     uint32        // Number of megabytes that argon2 should use. Defaults to 48.
-	HashIterations uint32        // Number of iterations that argon2 should use. Defaults to 7.
-	CookiePath     string        // Path of cookie. Defaults to "/"
-	CookieSecure   bool          // Whether to use secure cookies
-	CookieHTTPOnly bool          // Whether to only http
+	RedisConn           string             `config:"redis_conn"`            // Address (localhost:6379) or URL (redis://:password@localhost:6379/0) of Redis to keep sessions in. Leaving it blank, or Redis being unreachable on startup, uses the in-mem map store
+	RedisNamespace      string             `config:"redis_namespace"`       // Namespace to use to prefix keys in Redis
+	KMSPath             string             `config:"kms_path"`              // Where the generated secure cookie keys should be stored. Leaving it blank generates keys that are lost on restart.
+	DBPath              string             `config:"db_path"`               // Where the sqlite3 database should be stored (for rmb me)
+	IdleTimeout         time.Duration      `config:"idle_timeout"`          // How long they can be idle before they're logged out. Defaults to 1 hour.
+	ForcedTimeout       time.Duration      `config:"forced_timeout"`        // How long the session can persist before they're asked to log in again. Defaults to 3 days.
+	RmbMeTimeout        time.Duration      `config:"rmbme_timeout"`         // How long the "Remember Me" token is valid for. Defaults to 30 days.
+	RmbMeMaxLifetime    time.Duration      `config:"rmbme_max_lifetime"`    // How long a "Remember Me" login can last in total, however often its token is rotated. Leaving it at 0 means no limit.
+	RmbMePruneInterval  time.Duration      `config:"rmbme_prune_interval"`  // How often expired "Remember Me" tokens are deleted from the database. Leaving it at 0 disables pruning.
+	SweepInterval       time.Duration      `config:"sweep_interval"`        // How often expired sessions are evicted from the in-mem map store. Leaving it at 0 disables the sweeper.
+	SnapshotPath        string             `config:"snapshot_path"`         // File the in-mem map store is saved to, encrypted with keys from the KMS file, and restored from on startup. Leaving it blank keeps sessions in memory only.
+	SnapshotInterval    time.Duration      `config:"snapshot_interval"`     // How often the map store is saved to SnapshotPath. Leaving it at 0 only saves it on Close.
+	HashMemory          uint32             `config:"hash_memory"`           // Number of megabytes that argon2 should use. Defaults to 48.
+	HashIterations      uint32             `config:"hash_iterations"`       // Number of iterations that argon2 should use. Defaults to 7.
+	MaxConcurrentHashes int                `config:"max_concurrent_hashes"` // Number of argon2 hashes computed at once, further ones waiting until their context is done. Leaving it at 0 means no limit.
+	CookiePath          string             `config:"cookie_path"`           // Path of cookie. Defaults to "/".
+	CookieSecure        bool               `config:"cookie_secure"`         // Whether to use secure cookies
+	CookieHTTPOnly      bool               `config:"cookie_http_only"`      // Whether to only http
+	MaxSessionsPerUser  int                `config:"max_sessions_per_user"` // Most sessions a user can hold at once. Leaving it at 0 means no limit.
+	SessionLimitPolicy  SessionLimitPolicy `config:"session_limit_policy"`  // What happens when a user with MaxSessionsPerUser logs in again. Defaults to SessionLimitEvictOldest.
+	MaxStoredSessions   int                `config:"max_stored_sessions"`   // Most sessions the in-mem map store holds, evicting the least recently used beyond it. Leaving it at 0 means no limit.
+	MaxSessionDataSize  int                `config:"max_session_data_size"` // Most bytes of data that Session.Set may store for a session. Leaving it at 0 uses the store's limit, which it cannot be raised past (64 KiB for the map store, 512 KiB for Redis).
+
+	AccessTokenTimeout  time.Duration `config:"access_token_timeout"`  // How long JWT access tokens are valid for. Defaults to 15 minutes.
+	RefreshTokenTimeout time.Duration `config:"refresh_token_timeout"` // How long refresh tokens are valid for. Defaults to RmbMeTimeout.
+	TokenIssuer         string        `config:"token_issuer"`          // Value of the "iss" claim in access tokens
+	SigningKeys         []SigningKey  `config:"signing_keys"`          // Keys used to sign access tokens, the first being used for new tokens. Defaults to HS256 using the KMS file.
+
+	Clock             Clock                 // Source of the current time. Defaults to the system clock.
+	Logger            Logger                // Where events are logged, e.g. a *slog.Logger or ZapLogger. Leaving it nil discards logs.
+	AuditSink         AuditSink             // Where audit events are sent, e.g. a JSONLinesSink. Leaving it nil means no events are recorded.
+	SessionCodec      SessionCodec          // How session data is encoded in the store. Defaults to JSONCodec.
+	MetricsRegisterer prometheus.Registerer // Where Prometheus metrics are registered. Leaving it nil means metrics are not exported.
+	TracerProvider    trace.TracerProvider  // Provider of OpenTelemetry tracers. Defaults to the global provider.
+	HashSpanUserIDs   bool                  `config:"hash_span_user_ids"` // Whether user IDs are hashed with HMAC-SHA256, keyed from the KMS file, before being recorded on spans
+}
+
+// SessionLimitPolicy says what happens when a user with MaxSessionsPerUser logs in again.
+type SessionLimitPolicy string
+
+// Policies for users over MaxSessionsPerUser.
+const (
+	SessionLimitReject      SessionLimitPolicy = "reject"       // The new login fails with ErrTooManySessions
+	SessionLimitEvictOldest SessionLimitPolicy = "evict_oldest" // The session established longest ago is logged out
+)
+
+// Defaults applied by New to fields left at their zero value.
+const (
+	defaultIdleTimeout        = time.Hour
+	defaultForcedTimeout      = 3 * 24 * time.Hour
+	defaultRmbMeTimeout       = 30 * 24 * time.Hour
+	defaultHashMemory         = 48
+	defaultHashIterations     = 7
+	defaultCookiePath         = "/"
+	defaultAccessTokenTimeout = 15 * time.Minute
+)
+
+// ConfigError describes a config field that cannot be used.
+type ConfigError struct {
+	Field  string // Name of the offending field in Config, or the key it was read from by LoadConfig
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid config: " + e.Field + " " + e.Reason
+}
+
+// Validate checks that the config can be used by New, once defaults have been
+// applied to fields left at their zero value. A *ConfigError is returned for
+// the first field found to be invalid.
+func (c Config) Validate() error {
+	return c.withDefaults().validate()
+}
+
+// withDefaults returns the config with defaults applied to fields left at their zero value.
+// Defaults are shortened or lengthened to fit the fields that were set, so they never make a config invalid.
+func (c Config) withDefaults() Config {
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = defaultIdleTimeout
+		if c.ForcedTimeout > 0 && c.IdleTimeout > c.ForcedTimeout {
+			c.IdleTimeout = c.ForcedTimeout
+		}
+	}
+	if c.ForcedTimeout == 0 {
+		c.ForcedTimeout = defaultForcedTimeout
+		if c.ForcedTimeout < c.IdleTimeout {
+			c.ForcedTimeout = c.IdleTimeout
+		}
+	}
+	if c.RmbMeTimeout == 0 {
+		c.RmbMeTimeout = defaultRmbMeTimeout
+		if c.RmbMeTimeout < c.ForcedTimeout {
+			c.RmbMeTimeout = c.ForcedTimeout
+		}
+	}
+	if c.HashMemory == 0 {
+		c.HashMemory = defaultHashMemory
+	}
+	if c.HashIterations == 0 {
+		c.HashIterations = defaultHashIterations
+	}
+	if c.CookiePath == "" {
+		c.CookiePath = defaultCookiePath
+	}
+	if c.SessionLimitPolicy == "" {
+		c.SessionLimitPolicy = SessionLimitEvictOldest
+	}
+	if c.RefreshTokenTimeout == 0 {
+		c.RefreshTokenTimeout = c.RmbMeTimeout
+	}
+	if c.AccessTokenTimeout == 0 {
+		c.AccessTokenTimeout = defaultAccessTokenTimeout
+		if c.AccessTokenTimeout > c.RefreshTokenTimeout {
+			c.AccessTokenTimeout = c.RefreshTokenTimeout
+		}
+	}
+	if c.Clock == nil {
+		c.Clock = systemClock{}
+	}
+	if c.Logger == nil {
+		c.Logger = nopLogger{}
+	}
+	return c
+}
+
+// validate checks a config that defaults have been applied to.
+func (c Config) validate() error {
+	durations := []struct {
+		field string
+		value time.Duration
+	}{
+		{"IdleTimeout", c.IdleTimeout},
+		{"ForcedTimeout", c.ForcedTimeout},
+		{"RmbMeTimeout", c.RmbMeTimeout},
+		{"RmbMeMaxLifetime", c.RmbMeMaxLifetime},
+		{"RmbMePruneInterval", c.RmbMePruneInterval},
+		{"SweepInterval", c.SweepInterval},
+		{"SnapshotInterval", c.SnapshotInterval},
+		{"AccessTokenTimeout", c.AccessTokenTimeout},
+		{"RefreshTokenTimeout", c.RefreshTokenTimeout},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			return &ConfigError{d.field, "must not be negative"}
+		}
+	}
+
+	switch {
+	case c.IdleTimeout > c.ForcedTimeout:
+		return &ConfigError{"IdleTimeout", "must not be longer than ForcedTimeout"}
+	case c.RmbMeTimeout < c.ForcedTimeout:
+		return &ConfigError{"RmbMeTimeout", "must not be shorter than ForcedTimeout"}
+	case c.RefreshTokenTimeout < c.AccessTokenTimeout:
+		return &ConfigError{"RefreshTokenTimeout", "must not be shorter than AccessTokenTimeout"}
+	case c.MaxConcurrentHashes < 0:
+		return &ConfigError{"MaxConcurrentHashes", "must not be negative"}
+	case c.MaxSessionsPerUser < 0:
+		return &ConfigError{"MaxSessionsPerUser", "must not be negative"}
+	case c.SessionLimitPolicy != SessionLimitReject && c.SessionLimitPolicy != SessionLimitEvictOldest:
+		return &ConfigError{"SessionLimitPolicy", "must be reject or evict_oldest"}
+	case c.SnapshotPath != "" && c.KMSPath == "":
+		return &ConfigError{"SnapshotPath", "requires KMSPath, as snapshots are encrypted with its keys"}
+	case c.MaxStoredSessions < 0:
+		return &ConfigError{"MaxStoredSessions", "must not be negative"}
+	case c.MaxSessionDataSize < 0:
+		return &ConfigError{"MaxSessionDataSize", "must not be negative"}
+	case !strings.HasPrefix(c.CookiePath, "/"):
+		return &ConfigError{"CookiePath", "must start with /"}
+	}
+
+	ids := make(map[string]bool)
+	for i, key := range c.SigningKeys {
+		field := fmt.Sprintf("SigningKeys[%d]", i)
+		switch {
+		case key.ID == "" || key.ID == kmsTokenKeyID:
+			return &ConfigError{field, "must have an ID other than \"" + kmsTokenKeyID + "\""}
+		case ids[key.ID]:
+			return &ConfigError{field, "has the same ID as another key"}
+		case key.Algorithm != AlgRS256 && key.Algorithm != AlgEdDSA:
+			return &ConfigError{field, "must use " + AlgRS256 + " or " + AlgEdDSA}
+		case key.Key == nil:
+			return &ConfigError{field, "has no key"}
+		}
+		ids[key.ID] = true
+		if _, err := (jwtKey{id: key.ID, alg: key.Algorithm, signer: key.Key}).sign(nil); err != nil {
+			return &ConfigError{field, "cannot sign with " + key.Algorithm + ": " + err.Error()}
+		}
+	}
+	return nil
 }
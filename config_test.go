@@ -0,0 +1,73 @@
+package authlib
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	config := Config{}.withDefaults()
+	assert.Empty(t, config.validate(), "Zero config should be valid once defaults are applied")
+	assert.Equal(t, defaultIdleTimeout, config.IdleTimeout)
+	assert.Equal(t, defaultForcedTimeout, config.ForcedTimeout)
+	assert.Equal(t, defaultRmbMeTimeout, config.RmbMeTimeout)
+	assert.Equal(t, uint32(defaultHashMemory), config.HashMemory)
+	assert.Equal(t, uint32(defaultHashIterations), config.HashIterations)
+	assert.Equal(t, defaultCookiePath, config.CookiePath)
+	assert.Equal(t, defaultAccessTokenTimeout, config.AccessTokenTimeout)
+	assert.Equal(t, config.RmbMeTimeout, config.RefreshTokenTimeout)
+
+	// Defaults fit around the fields that were set
+	config = Config{ForcedTimeout: 10 * time.Minute, RmbMeTimeout: 10 * time.Minute}.withDefaults()
+	assert.Empty(t, config.validate(), "Defaults should not make a config invalid")
+	assert.Equal(t, 10*time.Minute, config.IdleTimeout)
+	assert.Equal(t, 10*time.Minute, config.AccessTokenTimeout)
+
+	config = Config{IdleTimeout: 100 * 24 * time.Hour}.withDefaults()
+	assert.Empty(t, config.validate(), "Defaults should not make a config invalid")
+	assert.Equal(t, config.IdleTimeout, config.ForcedTimeout)
+	assert.Equal(t, config.IdleTimeout, config.RmbMeTimeout)
+}
+
+func TestConfigValidate(t *testing.T) {
+	_, ed25519Key, _ := ed25519.GenerateKey(rand.Reader)
+	tests := []struct {
+		config Config
+		field  string
+	}{
+		{Config{IdleTimeout: -time.Second}, "IdleTimeout"},
+		{Config{IdleTimeout: time.Hour, ForcedTimeout: time.Minute}, "IdleTimeout"},
+		{Config{ForcedTimeout: time.Hour, RmbMeTimeout: time.Minute}, "RmbMeTimeout"},
+		{Config{AccessTokenTimeout: time.Hour, RefreshTokenTimeout: time.Minute}, "RefreshTokenTimeout"},
+		{Config{MaxConcurrentHashes: -1}, "MaxConcurrentHashes"},
+		{Config{CookiePath: "app"}, "CookiePath"},
+		{Config{SnapshotPath: "sessions.snapshot"}, "SnapshotPath"},
+		{Config{SnapshotPath: "sessions.snapshot", KMSPath: "auth.keys", SnapshotInterval: -time.Second}, "SnapshotInterval"},
+		{Config{SigningKeys: []SigningKey{{ID: kmsTokenKeyID, Algorithm: AlgEdDSA, Key: ed25519Key}}}, "SigningKeys[0]"},
+		{Config{SigningKeys: []SigningKey{{ID: "a", Algorithm: AlgEdDSA, Key: ed25519Key}, {ID: "a", Algorithm: AlgEdDSA, Key: ed25519Key}}}, "SigningKeys[1]"},
+		{Config{SigningKeys: []SigningKey{{ID: "a", Algorithm: AlgHS256, Key: ed25519Key}}}, "SigningKeys[0]"},
+		{Config{SigningKeys: []SigningKey{{ID: "a", Algorithm: AlgRS256, Key: ed25519Key}}}, "SigningKeys[0]"},
+	}
+	for _, test := range tests {
+		err := test.config.Validate()
+		var configErr *ConfigError
+		if assert.True(t, errors.As(err, &configErr), "Expected a ConfigError for %s, got %v", test.field, err) {
+			assert.Equal(t, test.field, configErr.Field)
+		}
+	}
+
+	valid := Config{SigningKeys: []SigningKey{{ID: "a", Algorithm: AlgEdDSA, Key: ed25519Key}}}
+	assert.Empty(t, valid.Validate(), "Config should be valid")
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	config := testObject().config
+	config.IdleTimeout = time.Hour
+	config.ForcedTimeout = time.Minute
+	assert.Panics(t, func() { New(config) }, "New should not accept an invalid config")
+}
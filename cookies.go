@@ -10,44 +10,37 @@ import (
 
 // secureCookie provides a handler to easily set and retrieve encrypted cookies.
 type secureCookie struct {
-	SC     *securecookie.SecureCookie
+	codecs []securecookie.Codec // The current keys first, followed by any previous ones
 	config Config
 }
 
-var scSingleton *secureCookie
+var scSingleton []securecookie.Codec
 var scOnce sync.Once
 
-// GetSC returns the singleton secure cookie instance.
-// Prepares & generates the keys if need be.
+// GetSC returns a secure cookie instance for the given config,
+// backed by the singleton codec. Prepares & generates the keys if need be.
 func getSC(config Config) *secureCookie {
 	scOnce.Do(func() {
-		kms := getKMS(config.KMSPath)
-		hashKey := kms.CookiesHash
-		blockKey := kms.CookiesBlock
-
-		scSingleton = &secureCookie{
-			SC:     securecookie.New(hashKey, blockKey),
-			config: config,
-		}
+		kms := getKMS(config.KMSPath, config.logger())
+		scSingleton = kms.codecs()
 	})
-	return scSingleton
+	return &secureCookie{
+		codecs: scSingleton,
+		config: config,
+	}
 }
 
 // Set creates a secure cookie using the given payload.
 func (sc *secureCookie) Set(w http.ResponseWriter, key string, payload cookieValue, cookieLifetime time.Duration) (err error) {
 	// Set the cookie
 	if cookieLifetime > 0 {
-		payload.Expires = time.Now().Add(cookieLifetime)
+		payload.Expires = sc.config.now().Add(cookieLifetime)
 	}
-	if encoded, encErr := sc.SC.Encode(key, payload); encErr == nil {
-		path := "/"
-		if len(sc.config.CookiePath) > 0 {
-			path = sc.config.CookiePath
-		}
+	if encoded, encErr := sc.encode(key, payload); encErr == nil {
 		cookie := http.Cookie{
 			Name:     key,
 			Value:    encoded,
-			Path:     path,
+			Path:     sc.config.CookiePath,
 			Secure:   sc.config.CookieSecure,
 			HttpOnly: sc.config.CookieHTTPOnly,
 			Expires:  payload.Expires,
@@ -65,14 +58,66 @@ func (sc *secureCookie) Get(r *http.Request, key string) (cookieValue, error) {
 	cookie, err := r.Cookie(key)
 	if err == nil {
 		var value cookieValue
-		err = sc.SC.Decode(key, cookie.Value, &value)
+		err = sc.decode(key, cookie.Value, &value)
 		if err != nil {
-			return cookieValue{}, err
+			return cookieValue{}, &CookieError{Name: key, Err: err}
 		}
-		if value.Expires.Before(time.Now()) {
+		if value.Expires.Before(sc.config.now()) {
 			return cookieValue{}, http.ErrNoCookie
 		}
 		return value, nil
 	}
 	return cookieValue{}, err
 }
+
+// encode encodes a value with the current keys.
+func (sc *secureCookie) encode(name string, value interface{}) (string, error) {
+	return securecookie.EncodeMulti(name, value, sc.codecs...)
+}
+
+// decode decodes a value encoded with the current or any previous keys.
+func (sc *secureCookie) decode(name, value string, dst interface{}) error {
+	return securecookie.DecodeMulti(name, value, dst, sc.codecs...)
+}
+
+// sessionKeyLength is the length of the random part of a session key, following the user ID.
+const sessionKeyLength = 32
+
+// CookieInfo describes a cookie or refresh token issued by authlib, leaving out its secret token.
+type CookieInfo struct {
+	Name      string // "auth", "rmbme" or "refresh"
+	UserID    string // The user an auth cookie belongs to. Other cookies do not carry it.
+	SessionID string // Identifies the session of an auth cookie, as in audit events
+	Expires   time.Time
+	Previous  bool // Whether it was encoded with keys since replaced by RotateKMSFile
+}
+
+// DecodeCookie decodes the value of a cookie or refresh token named name, using the keys
+// in the KMS file at kmsPath, for inspecting outside of a running app. The cookie is
+// decoded whether or not it has expired, and is not checked against the store.
+// Errors decoding the cookie are returned as a *CookieError.
+func DecodeCookie(kmsPath, name, value string) (info CookieInfo, err error) {
+	kms, err := readKMSFile(kmsPath)
+	if err != nil {
+		return info, err
+	}
+
+	var decoded cookieValue
+	for i, codec := range kms.codecs() {
+		if err = codec.Decode(name, value, &decoded); err == nil {
+			info.Previous = i > 0
+			break
+		}
+	}
+	if err != nil {
+		return info, &CookieError{Name: name, Err: err}
+	}
+
+	info.Name = name
+	info.Expires = decoded.Expires
+	if name == "auth" && len(decoded.Key) > sessionKeyLength {
+		info.UserID = decoded.Key[:len(decoded.Key)-sessionKeyLength-1]
+		info.SessionID = sessionID(decoded.Key)
+	}
+	return info, nil
+}
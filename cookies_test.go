@@ -1,7 +1,30 @@
 package authlib
 
-import "testing"
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func TestGetSC(t *testing.T) {
 	getSC(testObject().config)
 }
+
+func TestDecodeCookie(t *testing.T) {
+	a := testObject()
+	w := httptest.NewRecorder()
+	key, err := a.saveLogin(context.Background(), saveLoginOpts{w: w, userID: "some-user"})
+	assert.Empty(t, err, "Error saving login")
+	cookie := w.Result().Cookies()[0]
+
+	info, err := DecodeCookie(testKMSConfigPath, cookie.Name, cookie.Value)
+	assert.Empty(t, err, "Error decoding cookie")
+	assert.Equal(t, "some-user", info.UserID, "User ID should be read from the session key")
+	assert.Equal(t, sessionID(key), info.SessionID, "Session ID should match audit events")
+	assert.False(t, info.Previous, "Cookie should use the current keys")
+
+	_, err = DecodeCookie(testKMSConfigPath, cookie.Name, cookie.Value+"x")
+	assert.ErrorIs(t, err, ErrInvalidCookie, "Manipulated cookie should be rejected")
+}
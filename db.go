@@ -1,30 +1,52 @@
 package authlib
 
 import (
+	"context"
+	"errors"
 	"sync"
+	"time"
 )
 
-// Database - used to connect to the database
+// Database - used to connect to the database.
+// Every operation besides Prune returns the context's error
+// without touching the data once the context is done, and
+// errDBClosed once the database has been closed.
 type database struct {
 	Connected bool
 	DB        map[string]Store
+	mux       sync.Mutex
+	stop      chan struct{} // Stops the pruning routine, nil if it is not running
 }
 
+// Store is a single remember me (or refresh) token entry.
+// Tokens are grouped into families: every use of a token rotates it into
+// a new entry of the same family, and marks the old entry as rotated.
 type Store struct {
-	UserID    string
-	TokenHash string
+	UserID        string
+	TokenHash     string
+	FamilyID      string
+	Rotated       bool      // Set once the token has been exchanged for a newer one
+	IssuedAt      time.Time // When this token was issued
+	Expires       time.Time // When this token expires, capped at FamilyExpires
+	FamilyExpires time.Time // When the family expires, however often it is rotated. Zero if unlimited.
 }
 
 var dbSingleton *database
 var dbOnce sync.Once
 
-// getDB returns the dbSingleton database instance
+// errDBClosed is returned by operations on a database that has been closed.
+var errDBClosed = errors.New("the database is closed")
+
+// getDB returns the dbSingleton database instance, reopening it if it was closed
 func getDB(dbPath string) *database {
 	dbOnce.Do(func() {
 		db := database{}
 		db.init(dbPath)
 		dbSingleton = &db
 	})
+	dbSingleton.mux.Lock()
+	dbSingleton.Connected = true
+	dbSingleton.mux.Unlock()
 	return dbSingleton
 }
 
@@ -34,37 +56,177 @@ func (d *database) init(dbPath string) {
 	d.DB = make(map[string]Store)
 }
 
-// Close the database connection
+// closed returns errDBClosed if the database has been closed. The lock must be held.
+func (d *database) closed() error {
+	if !d.Connected {
+		return errDBClosed
+	}
+	return nil
+}
+
+// Close the database connection, stopping the pruning routine if running
 func (d *database) Close() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
 	d.Connected = false
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+	}
 }
 
 // Insert a new entry into the database.
-func (d *database) Insert(key, hashedToken, userID string) (err error) {
-	d.DB[key] = Store{UserID: userID, TokenHash: hashedToken}
+func (d *database) Insert(ctx context.Context, key string, entry Store) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if err = d.closed(); err != nil {
+		return
+	}
+	d.DB[key] = entry
 	return nil
 }
 
-// Fetch a user ID and hashed token, given a key.
-func (d *database) Fetch(key string) (userID, hashedToken string, err error) {
-	result, ok := d.DB[key]
-	if !ok {
+// Fetch an entry, given a key. If no entry is found,
+// the returned entry will have an empty user ID.
+func (d *database) Fetch(ctx context.Context, key string) (entry Store, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if err = d.closed(); err != nil {
 		return
 	}
+	return d.DB[key], nil
+}
 
-	return result.UserID, result.TokenHash, nil
+// Rotate flags an entry as having been exchanged for a newer token, and inserts
+// the newer token's entry, returning the old entry as it was. The old entry is kept
+// so that reuse can be detected. Both happen under the lock, so that of several
+// callers rotating the same token at once, only one finds it not yet rotated, and
+// revoking the family as soon as reuse is detected also revokes the newer token.
+// If the old entry is missing or already rotated, nothing is inserted.
+// If no entry is found, the returned entry will have an empty user ID.
+func (d *database) Rotate(ctx context.Context, key, newKey string, newEntry Store) (entry Store, alreadyRotated bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if err = d.closed(); err != nil {
+		return
+	}
+	entry, ok := d.DB[key]
+	if !ok {
+		return Store{}, false, nil
+	}
+	if entry.Rotated {
+		return entry, true, nil
+	}
+	rotated := entry
+	rotated.Rotated = true
+	d.DB[key] = rotated
+	d.DB[newKey] = newEntry
+	return entry, false, nil
 }
 
 // RemoveSingle removes a single entry from the database
 // based on a given key. Used when a user wants to log out
 // from a single session.
-func (d *database) RemoveSingle(key string) {
+func (d *database) RemoveSingle(ctx context.Context, key string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if err = d.closed(); err != nil {
+		return
+	}
 	delete(d.DB, key)
+	return nil
+}
+
+// RemoveFamily removes every entry that belongs to the same
+// token family. Used when a session is logged out, or when
+// a token is found to have been reused.
+func (d *database) RemoveFamily(ctx context.Context, familyID string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if err = d.closed(); err != nil {
+		return
+	}
+	for key, entry := range d.DB {
+		if entry.FamilyID == familyID {
+			delete(d.DB, key)
+		}
+	}
+	return nil
 }
 
 // RemoveAll removes all entries from the database
 // based on a given user ID. Used when a user wants to log out
 // from all sessions.
-func (d *database) RemoveAll(userID string) {
-	// d.DB.Exec(`DELETE FROM tokens WHERE user_id = $1`, userID)
+func (d *database) RemoveAll(ctx context.Context, userID string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if err = d.closed(); err != nil {
+		return
+	}
+	for key, entry := range d.DB {
+		if entry.UserID == userID {
+			delete(d.DB, key)
+		}
+	}
+	return nil
+}
+
+// Prune removes all entries that expired before the given time,
+// returning the number of entries removed.
+func (d *database) Prune(now time.Time) (removed int) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	for key, entry := range d.DB {
+		if now.After(entry.Expires) {
+			delete(d.DB, key)
+			removed++
+		}
+	}
+	return
+}
+
+// startPruning runs Prune in the background at the given interval, reading
+// the time from the clock, until the database is closed. Calls made while
+// pruning is running have no effect.
+func (d *database) startPruning(interval time.Duration, clock Clock, log Logger) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	d.stop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if removed := d.Prune(clock.Now()); removed > 0 {
+					log.Debug("Pruned expired remember me tokens", logRemoved, removed)
+				}
+			}
+		}
+	}()
 }
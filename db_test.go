@@ -1,7 +1,11 @@
 package authlib
 
 import (
+	"context"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestDB(t *testing.T) {
@@ -9,24 +13,103 @@ func TestDB(t *testing.T) {
 	key := randStr(64)
 	token := randStr(64)
 	userID := randStr(64)
-	err := db.Insert(key, quickHash(token), userID)
-	db.Insert(key+key, quickHash(token), userID)
+	entry := Store{
+		UserID:    userID,
+		TokenHash: quickHash(token),
+		FamilyID:  randStr(16),
+		Expires:   time.Now().Add(time.Minute),
+	}
+	familyID := entry.FamilyID
+	err := db.Insert(context.Background(), key, entry)
+	db.Insert(context.Background(), key+key, entry)
 	if err != nil {
 		t.Error("Could not insert data:", err)
 	}
 
-	fetchedID, hashedToken, err := db.Fetch(key)
+	entry, err = db.Fetch(context.Background(), key)
 	if err != nil {
 		t.Error("Could not fetch data:", err)
-	} else if userID != fetchedID {
-		t.Errorf("Wrong user ID retrieved. Expected %s, got %s", userID, fetchedID)
+	} else if userID != entry.UserID {
+		t.Errorf("Wrong user ID retrieved. Expected %s, got %s", userID, entry.UserID)
 	} else if match, _ := ComparePasswordAndHash(ComparePasswordOpts{
 		Password:    token,
-		EncodedHash: hashedToken,
+		EncodedHash: entry.TokenHash,
 	}); !match {
 		t.Error("Wrong hashed token retrieved.")
 	}
 
-	db.RemoveSingle(key)
-	db.RemoveAll(userID)
+	newKey := randStr(64)
+	if _, alreadyRotated, _ := db.Rotate(context.Background(), key, newKey, Store{UserID: userID}); alreadyRotated {
+		t.Error("Entry was reported as rotated before it was")
+	}
+	if entry, _ = db.Fetch(context.Background(), key); !entry.Rotated {
+		t.Error("Entry was not marked as rotated")
+	}
+	if entry, _ = db.Fetch(context.Background(), newKey); entry.UserID != userID {
+		t.Error("Newer entry was not inserted")
+	}
+	if _, alreadyRotated, _ := db.Rotate(context.Background(), key, randStr(64), Store{UserID: userID}); !alreadyRotated {
+		t.Error("Entry rotated twice was not reported")
+	}
+
+	db.RemoveSingle(context.Background(), key)
+	if entry, _ = db.Fetch(context.Background(), key); entry.UserID != "" {
+		t.Error("Entry was not removed")
+	}
+
+	db.RemoveFamily(context.Background(), familyID)
+	if entry, _ = db.Fetch(context.Background(), key+key); entry.UserID != "" {
+		t.Error("Family was not removed")
+	}
+
+	db.Insert(context.Background(), key, Store{UserID: userID, FamilyID: familyID})
+	db.RemoveAll(context.Background(), userID)
+	if entry, _ = db.Fetch(context.Background(), key); entry.UserID != "" {
+		t.Error("Entries for user were not removed")
+	}
+}
+
+func TestDBPrune(t *testing.T) {
+	db := getDB(testDBPath)
+	key := randStr(64)
+	now := time.Now()
+	db.Insert(context.Background(), key, Store{UserID: randStr(64), Expires: now.Add(time.Minute)})
+
+	db.Prune(now)
+	if entry, _ := db.Fetch(context.Background(), key); entry.UserID == "" {
+		t.Error("Entry was pruned before it expired")
+	}
+
+	db.Prune(now.Add(2 * time.Minute))
+	if entry, _ := db.Fetch(context.Background(), key); entry.UserID != "" {
+		t.Error("Expired entry was not pruned")
+	}
+}
+
+func TestDBPruneInBackground(t *testing.T) {
+	db := &database{}
+	db.init(testDBPath)
+	defer db.Close()
+	clock := newTestClock()
+	key := randStr(64)
+	db.Insert(context.Background(), key, Store{UserID: randStr(64), Expires: clock.Now().Add(time.Minute)})
+
+	db.startPruning(time.Millisecond, clock, nopLogger{})
+	clock.advance(2 * time.Minute)
+	assert.Eventually(t, func() bool {
+		entry, _ := db.Fetch(context.Background(), key)
+		return entry.UserID == ""
+	}, time.Second, time.Millisecond, "Expired entry was not pruned in the background")
+
+	// Pruning can be started again once the database is closed and reopened
+	db.Close()
+	db.init(testDBPath)
+	key = randStr(64)
+	db.Insert(context.Background(), key, Store{UserID: randStr(64), Expires: clock.Now().Add(time.Minute)})
+	db.startPruning(time.Millisecond, clock, nopLogger{})
+	clock.advance(2 * time.Minute)
+	assert.Eventually(t, func() bool {
+		entry, _ := db.Fetch(context.Background(), key)
+		return entry.UserID == ""
+	}, time.Second, time.Millisecond, "Pruning was not restarted after closing")
 }
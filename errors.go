@@ -0,0 +1,72 @@
+package authlib
+
+import (
+	"context"
+	"errors"
+)
+
+// Errors returned by authlib. Errors may be wrapped with more detail,
+// so they should be checked for with errors.Is.
+var (
+	ErrWrongPassword       = errors.New("the password does not match")
+	ErrSessionExpired      = errors.New("the session has expired")
+	ErrInvalidCookie       = errors.New("the cookie is invalid")
+	ErrTokenReuse          = errors.New("a rotated token was presented again")
+	ErrInvalidHash         = errors.New("the encoded hash is not in the correct format")
+	ErrStoreUnavailable    = errors.New("the session store is unavailable")
+	ErrInvalidToken        = errors.New("the access token is malformed or its signature is invalid")
+	ErrTokenExpired        = errors.New("the access token has expired")
+	ErrInvalidRefreshToken = errors.New("the refresh token is invalid")
+	ErrNoSession           = errors.New("the request has no session")
+	ErrSessionDataTooLarge = errors.New("the session data is too large")
+	ErrTooManySessions     = errors.New("the user has too many sessions")
+)
+
+// StoreError is returned when the session store or remember me database
+// could not be reached. It matches ErrStoreUnavailable.
+type StoreError struct {
+	Op  string // The operation that failed, e.g. "get session"
+	Err error
+}
+
+func (e *StoreError) Error() string {
+	return "could not " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrStoreUnavailable.
+func (e *StoreError) Is(target error) bool {
+	return target == ErrStoreUnavailable
+}
+
+// CookieError is returned when a cookie was sent but could not be accepted,
+// e.g. as it was manipulated, or its token does not match. It matches ErrInvalidCookie.
+type CookieError struct {
+	Name string // Name of the cookie, "auth" or "rmbme"
+	Err  error
+}
+
+func (e *CookieError) Error() string {
+	return "invalid " + e.Name + " cookie: " + e.Err.Error()
+}
+
+func (e *CookieError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrInvalidCookie.
+func (e *CookieError) Is(target error) bool {
+	return target == ErrInvalidCookie
+}
+
+// storeError wraps an error from the store or database in a StoreError.
+// Errors from a done context are returned as is, as the store did not fail.
+func storeError(op string, err error) error {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return &StoreError{Op: op, Err: err}
+}
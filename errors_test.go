@@ -0,0 +1,67 @@
+package authlib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckLoginErrors(t *testing.T) {
+	clock := newTestClock()
+	config := testObject().config
+	config.Clock = clock
+	a := New(config)
+
+	// Manipulated cookie
+	recorder := httptest.NewRecorder()
+	http.SetCookie(recorder, &http.Cookie{Name: "auth", Value: randStr(64)})
+	_, _, err := a.CheckLogin(HTTPOpts{
+		HTTPWriter:  httptest.NewRecorder(),
+		HTTPRequest: &http.Request{Header: http.Header{"Cookie": recorder.HeaderMap["Set-Cookie"]}},
+	})
+	assert.True(t, errors.Is(err, ErrInvalidCookie), "Manipulated cookie should be reported as invalid, got %v", err)
+	var cookieErr *CookieError
+	if assert.True(t, errors.As(err, &cookieErr), "Error should be a CookieError") {
+		assert.Equal(t, "auth", cookieErr.Name)
+	}
+
+	// Expired session without remember me
+	pw := randStr(64)
+	recorder = httptest.NewRecorder()
+	a.AttemptLogin(AttemptLoginOpts{
+		HTTPWriter:       recorder,
+		ID:               randStr(64),
+		ProvidedPassword: pw,
+		PasswordHash:     a.HashPassword(HashPasswordOpts{Password: pw}),
+	})
+	clock.advance(config.IdleTimeout + time.Second)
+	_, valid, err := a.CheckLogin(HTTPOpts{
+		HTTPWriter:  httptest.NewRecorder(),
+		HTTPRequest: &http.Request{Header: http.Header{"Cookie": recorder.HeaderMap["Set-Cookie"]}},
+	})
+	assert.False(t, valid, "Expired session should not be valid")
+	assert.Equal(t, ErrSessionExpired, err, "Expired session was not reported")
+}
+
+func TestInvalidHashError(t *testing.T) {
+	for _, hash := range []string{"", "$argon2id$v=1$m=1,t=1,p=1$c2FsdA$aGFzaA", "$argon2id$v=19$m=1,t=1,p=1$!$aGFzaA"} {
+		_, err := ComparePasswordAndHash(ComparePasswordOpts{Password: randStr(8), EncodedHash: hash})
+		assert.True(t, errors.Is(err, ErrInvalidHash), "Hash %q should be reported as invalid, got %v", hash, err)
+	}
+}
+
+func TestStoreError(t *testing.T) {
+	err := storeError("get session", errors.New("connection refused"))
+	assert.True(t, errors.Is(err, ErrStoreUnavailable), "StoreError should match ErrStoreUnavailable")
+	var storeErr *StoreError
+	if assert.True(t, errors.As(err, &storeErr), "Error should be a StoreError") {
+		assert.Equal(t, "get session", storeErr.Op)
+	}
+	assert.Equal(t, context.Canceled, storeError("get session", context.Canceled), "Context errors should not be wrapped")
+	assert.Nil(t, storeError("get session", nil))
+}
@@ -0,0 +1,102 @@
+package authlib
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// SessionInfo describes the user and session that a hook is called for.
+type SessionInfo struct {
+	UserID    string
+	SessionID string        // Same as in audit events. Empty if there is no session yet.
+	Request   *http.Request // The request being handled, if known
+}
+
+// Hook is called synchronously when something happens to a session.
+type Hook func(ctx context.Context, session SessionInfo)
+
+// BeforeLoginHook is called before a login attempt is checked, or a user logs in again
+// with a remember me cookie or refresh token. Returning an error rejects the login, and
+// the error is returned by AttemptLogin, CheckLogin or Refresh.
+type BeforeLoginHook func(ctx context.Context, session SessionInfo) error
+
+// hooks holds the hooks registered on an Object.
+type hooks struct {
+	mux              sync.RWMutex
+	beforeLogin      []BeforeLoginHook
+	afterLogin       []Hook
+	onLogout         []Hook
+	onSessionRefresh []Hook
+	onRmbMeUse       []Hook
+	onSessionEvicted []Hook
+}
+
+// BeforeLogin registers a hook called by AttemptLogin before the password is checked,
+// e.g. to reject logins of suspended users. It is also called before CheckLogin creates
+// a session from a remember me cookie, and before Refresh issues new tokens; if it rejects
+// them, the remember me or refresh token's family is revoked. Hooks are called in the
+// order they were registered, until one of them returns an error.
+func (a *Object) BeforeLogin(hook BeforeLoginHook) {
+	a.hooks.mux.Lock()
+	defer a.hooks.mux.Unlock()
+	a.hooks.beforeLogin = append(a.hooks.beforeLogin, hook)
+}
+
+// AfterLogin registers a hook called once AttemptLogin has created a session.
+func (a *Object) AfterLogin(hook Hook) {
+	a.hooks.add(&a.hooks.afterLogin, hook)
+}
+
+// OnLogout registers a hook called when a session is logged out.
+func (a *Object) OnLogout(hook Hook) {
+	a.hooks.add(&a.hooks.onLogout, hook)
+}
+
+// OnSessionRefresh registers a hook called when CheckLogin accepts a session,
+// extending its idle timeout.
+func (a *Object) OnSessionRefresh(hook Hook) {
+	a.hooks.add(&a.hooks.onSessionRefresh, hook)
+}
+
+// OnRememberMeUse registers a hook called when CheckLogin creates a new session
+// from a remember me cookie, e.g. to notify the user of a login from a new device.
+func (a *Object) OnRememberMeUse(hook Hook) {
+	a.hooks.add(&a.hooks.onRmbMeUse, hook)
+}
+
+// OnSessionEvicted registers a hook called when a session is logged out to make room
+// for another, as the user had MaxSessionsPerUser or the store held MaxStoredSessions.
+// The hook is not given a request, as the session's owner is not the one being served.
+func (a *Object) OnSessionEvicted(hook Hook) {
+	a.hooks.add(&a.hooks.onSessionEvicted, hook)
+}
+
+func (h *hooks) add(list *[]Hook, hook Hook) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	*list = append(*list, hook)
+}
+
+// runBeforeLogin calls the BeforeLogin hooks, returning the first error.
+func (h *hooks) runBeforeLogin(ctx context.Context, session SessionInfo) error {
+	h.mux.RLock()
+	registered := h.beforeLogin
+	h.mux.RUnlock()
+	for _, hook := range registered {
+		if err := hook(ctx, session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run calls every hook in the list.
+func (h *hooks) run(ctx context.Context, list *[]Hook, session SessionInfo) {
+	h.mux.RLock()
+	registered := *list
+	h.mux.RUnlock()
+	for _, hook := range registered {
+		hook(ctx, session)
+	}
+}
@@ -0,0 +1,179 @@
+package authlib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBeforeLoginHook(t *testing.T) {
+	a := testObject()
+	errSuspended := errors.New("user is suspended")
+	suspended := randStr(64)
+	a.BeforeLogin(func(ctx context.Context, session SessionInfo) error {
+		if session.UserID == suspended {
+			return errSuspended
+		}
+		return nil
+	})
+	var loggedIn []SessionInfo
+	a.AfterLogin(func(ctx context.Context, session SessionInfo) {
+		loggedIn = append(loggedIn, session)
+	})
+
+	pw := randStr(64)
+	hashedPw := a.HashPassword(HashPasswordOpts{Password: pw})
+	recorder := httptest.NewRecorder()
+	ok, err := a.AttemptLogin(AttemptLoginOpts{HTTPWriter: recorder, ID: suspended, ProvidedPassword: pw, PasswordHash: hashedPw})
+	assert.False(t, ok, "Login should have been rejected by the hook")
+	assert.Equal(t, errSuspended, err, "Hook error was not returned")
+	_, err = getCookie(recorder, "auth")
+	assert.NotEmpty(t, err, "Cookie should not have been set")
+
+	id := randStr(64)
+	ok, err = a.AttemptLogin(AttemptLoginOpts{HTTPWriter: httptest.NewRecorder(), ID: id, ProvidedPassword: pw, PasswordHash: hashedPw})
+	assert.True(t, ok, "Login was not accepted")
+	assert.Empty(t, err, "An error occurred while logging in")
+	if assert.Len(t, loggedIn, 1, "AfterLogin should only be called for successful logins") {
+		assert.Equal(t, id, loggedIn[0].UserID)
+		assert.NotEmpty(t, loggedIn[0].SessionID, "Session ID was not passed to the hook")
+	}
+}
+
+func TestSessionHooks(t *testing.T) {
+	clock := newTestClock()
+	config := testObject().config
+	config.Clock = clock
+	a := New(config)
+
+	var refreshed, rmbMeUsed, loggedOut []SessionInfo
+	a.OnSessionRefresh(func(ctx context.Context, session SessionInfo) { refreshed = append(refreshed, session) })
+	a.OnRememberMeUse(func(ctx context.Context, session SessionInfo) { rmbMeUsed = append(rmbMeUsed, session) })
+	a.OnLogout(func(ctx context.Context, session SessionInfo) { loggedOut = append(loggedOut, session) })
+
+	id := randStr(64)
+	pw := randStr(64)
+	recorder := httptest.NewRecorder()
+	a.AttemptLogin(AttemptLoginOpts{
+		HTTPWriter:       recorder,
+		ID:               id,
+		ProvidedPassword: pw,
+		PasswordHash:     a.HashPassword(HashPasswordOpts{Password: pw}),
+		RmbMe:            true,
+	})
+	request := &http.Request{Header: http.Header{"Cookie": recorder.HeaderMap["Set-Cookie"]}}
+
+	_, valid, _ := a.CheckLogin(HTTPOpts{HTTPWriter: httptest.NewRecorder(), HTTPRequest: request})
+	assert.True(t, valid, "Login was not accepted")
+	if assert.Len(t, refreshed, 1, "OnSessionRefresh was not called") {
+		assert.Equal(t, id, refreshed[0].UserID)
+		assert.Equal(t, request, refreshed[0].Request, "Request was not passed to the hook")
+	}
+
+	// Once the session has expired, remember me creates a new one
+	clock.advance(config.IdleTimeout + time.Second)
+	recorder = httptest.NewRecorder()
+	_, valid, _ = a.CheckLogin(HTTPOpts{HTTPWriter: recorder, HTTPRequest: request})
+	assert.True(t, valid, "Remember me was not accepted")
+	if assert.Len(t, rmbMeUsed, 1, "OnRememberMeUse was not called") {
+		assert.Equal(t, id, rmbMeUsed[0].UserID)
+	}
+	assert.Len(t, refreshed, 1, "OnSessionRefresh should not be called for remember me")
+
+	a.Logout(HTTPOpts{
+		HTTPWriter:  httptest.NewRecorder(),
+		HTTPRequest: &http.Request{Header: http.Header{"Cookie": recorder.HeaderMap["Set-Cookie"]}},
+	})
+	if assert.Len(t, loggedOut, 1, "OnLogout was not called") {
+		assert.Equal(t, id, loggedOut[0].UserID)
+		assert.Equal(t, rmbMeUsed[0].SessionID, loggedOut[0].SessionID, "Logout should refer to the remember me session")
+	}
+}
+
+func TestBeforeLoginHookRmbMe(t *testing.T) {
+	audit := &MemoryAuditSink{}
+	clock := newTestClock()
+	config := testObject().config
+	config.Clock = clock
+	config.AuditSink = audit
+	a := New(config)
+	errSuspended := errors.New("user is suspended")
+	suspended := false
+	a.BeforeLogin(func(ctx context.Context, session SessionInfo) error {
+		if suspended {
+			return errSuspended
+		}
+		return nil
+	})
+
+	id := randStr(64)
+	pw := randStr(64)
+	recorder := httptest.NewRecorder()
+	a.AttemptLogin(AttemptLoginOpts{
+		HTTPWriter:       recorder,
+		ID:               id,
+		ProvidedPassword: pw,
+		PasswordHash:     a.HashPassword(HashPasswordOpts{Password: pw}),
+		RmbMe:            true,
+	})
+	request := &http.Request{Header: http.Header{"Cookie": recorder.HeaderMap["Set-Cookie"]}}
+
+	// Once the session has expired, the hook is asked before remember me creates a new one
+	suspended = true
+	audit.Reset()
+	clock.advance(config.IdleTimeout + time.Second)
+	_, valid, err := a.CheckLogin(HTTPOpts{HTTPWriter: httptest.NewRecorder(), HTTPRequest: request})
+	assert.False(t, valid, "Remember me should have been rejected by the hook")
+	assert.Equal(t, errSuspended, err, "Hook error was not returned")
+	if events := audit.Events(); assert.Len(t, events, 1, "Rejection was not audited") {
+		assert.Equal(t, AuditRmbMeLogin, events[0].Type)
+		assert.Equal(t, loginLocked, events[0].Outcome)
+		assert.Equal(t, id, events[0].UserID)
+	}
+
+	// The remember me cookie was revoked, so it stays rejected
+	suspended = false
+	_, valid, _ = a.CheckLogin(HTTPOpts{HTTPWriter: httptest.NewRecorder(), HTTPRequest: request})
+	assert.False(t, valid, "Remember me cookie should have been revoked")
+}
+
+func TestBeforeLoginHookRefresh(t *testing.T) {
+	audit := &MemoryAuditSink{}
+	config := testObject().config
+	config.AuditSink = audit
+	a := New(config)
+	errSuspended := errors.New("user is suspended")
+	suspended := false
+	a.BeforeLogin(func(ctx context.Context, session SessionInfo) error {
+		if suspended {
+			return errSuspended
+		}
+		return nil
+	})
+
+	id := randStr(64)
+	tokens, err := a.IssueTokens(IssueTokensOpts{UserID: id})
+	assert.Empty(t, err, "Error issuing tokens")
+	tokens, err = a.Refresh(RefreshOpts{RefreshToken: tokens.RefreshToken})
+	assert.Empty(t, err, "Refresh should be accepted")
+
+	suspended = true
+	audit.Reset()
+	_, err = a.Refresh(RefreshOpts{RefreshToken: tokens.RefreshToken})
+	assert.Equal(t, errSuspended, err, "Hook error was not returned")
+	if events := audit.Events(); assert.Len(t, events, 1, "Rejection was not audited") {
+		assert.Equal(t, AuditRefresh, events[0].Type)
+		assert.Equal(t, loginLocked, events[0].Outcome)
+		assert.Equal(t, id, events[0].UserID)
+	}
+
+	// The refresh token's family was revoked, so it stays rejected
+	suspended = false
+	_, err = a.Refresh(RefreshOpts{RefreshToken: tokens.RefreshToken})
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken, "Refresh token should have been revoked")
+}
@@ -0,0 +1,10 @@
+// Package testlogin lets authlibtest log users in without a password. The login
+// is not exported by authlib, as apps should not be able to skip the password
+// check; authlib sets Login when it is initialised instead.
+package testlogin
+
+import "net/http"
+
+// Login logs the user in on object, an *authlib.Object, without checking a
+// password, writing the cookies to w. BeforeLogin hooks are still called.
+var Login func(object any, w http.ResponseWriter, userID string, rmbMe bool) (ok bool, err error)
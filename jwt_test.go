@@ -0,0 +1,61 @@
+package authlib
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignAndVerifyJWT(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keys := []jwtKey{
+		{id: "hs", alg: AlgHS256, secret: []byte(randStr(64))},
+		{id: "ed", alg: AlgEdDSA, signer: edKey},
+		{id: "rsa", alg: AlgRS256, signer: rsaKey},
+	}
+
+	now := time.Now()
+	claims := AccessClaims{
+		Subject:   randStr(16),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Minute).Unix(),
+		ID:        randStr(16),
+	}
+	for _, key := range keys {
+		token, err := signJWT(key, claims)
+		assert.Empty(t, err, "Error signing token with "+key.alg)
+
+		verified, err := verifyJWT(token, keys, now)
+		assert.Empty(t, err, "Error verifying token signed with "+key.alg)
+		assert.Equal(t, claims, verified, "Wrong claims returned for "+key.alg)
+
+		_, err = verifyJWT(token+"a", keys, now)
+		assert.Equal(t, ErrInvalidToken, err, "Tampered token should not have been accepted for "+key.alg)
+
+		_, err = verifyJWT(token, keys, now.Add(time.Hour))
+		assert.Equal(t, ErrTokenExpired, err, "Expired token should not have been accepted for "+key.alg)
+	}
+}
+
+func TestVerifyJWTKeyMismatch(t *testing.T) {
+	secret := []byte(randStr(64))
+	token, err := signJWT(jwtKey{id: "a", alg: AlgHS256, secret: secret}, AccessClaims{
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+	})
+	assert.Empty(t, err, "Error signing token")
+
+	_, err = verifyJWT(token, []jwtKey{{id: "b", alg: AlgHS256, secret: secret}}, time.Now())
+	assert.Equal(t, errUnknownKey, err, "Token signed with unknown key ID should not have been accepted")
+
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, err = verifyJWT(token, []jwtKey{{id: "a", alg: AlgEdDSA, signer: edKey}}, time.Now())
+	assert.Equal(t, ErrInvalidToken, err, "Token with mismatched algorithm should not have been accepted")
+
+	_, err = signJWT(jwtKey{id: "a", alg: AlgRS256, signer: edKey}, AccessClaims{})
+	assert.Equal(t, errUnsupportedKey, err, "Ed25519 key should not be usable for RS256")
+}
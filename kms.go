@@ -1,19 +1,64 @@
 package authlib
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"sync"
 
 	"github.com/gorilla/securecookie"
+	"golang.org/x/crypto/hkdf"
 )
 
+// spanUserKeyInfo separates the key that user IDs are hashed with on spans from
+// any other key derived from the KMS.
+var spanUserKeyInfo = []byte("authlib span user ID")
+
 // keyManagementStore holds all the relevant keys that is used by the program in runtime.
 type keyManagementStore struct {
 	CookiesHash  []byte
 	CookiesBlock []byte
+	TokenKey     []byte // HMAC key used to sign HS256 access tokens
+
+	// Keys replaced by RotateKMSFile, newest first. Cookies are still decoded and
+	// access tokens still verified with them, so that sessions survive a rotation.
+	Previous []previousKeys `json:",omitempty"`
+}
+
+// previousKeys are the keys of a keyManagementStore replaced by a rotation.
+type previousKeys struct {
+	CookiesHash  []byte
+	CookiesBlock []byte
+	TokenKey     []byte `json:",omitempty"` // Missing from files rotated before it was kept
+}
+
+// codecs returns the codecs to encode cookies with, the current keys first.
+func (kms *keyManagementStore) codecs() []securecookie.Codec {
+	pairs := [][]byte{kms.CookiesHash, kms.CookiesBlock}
+	for _, keys := range kms.Previous {
+		pairs = append(pairs, keys.CookiesHash, keys.CookiesBlock)
+	}
+	return securecookie.CodecsFromPairs(pairs...)
+}
+
+// spanUserKey derives the key that user IDs are hashed with on spans from the cookie
+// keys. Hashes recorded before a rotation do not match those recorded after it.
+func (kms *keyManagementStore) spanUserKey() []byte {
+	return deriveKey(kms.CookiesHash, spanUserKeyInfo)
+}
+
+// deriveKey derives a 32 byte key for the purpose given by info from a secret, with HKDF-SHA256.
+func deriveKey(secret, info []byte) []byte {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), key); err != nil {
+		panic("authlib: could not derive key: " + err.Error())
+	}
+	return key
 }
 
 var kmsSingleton *keyManagementStore
@@ -22,57 +67,128 @@ var kmsOnce sync.Once
 // getKMS returns the program's key management store.
 // On first run, will attempt to fetch the keys from the path.
 // If not found, will generate a new set and save it.
-func getKMS(configPath string) *keyManagementStore {
+// With an empty path, keys are generated but never saved.
+// Panics if the file exists but cannot be read.
+func getKMS(configPath string, log Logger) *keyManagementStore {
 	kmsOnce.Do(func() {
 		var kms keyManagementStore
-		if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		if configPath == "" {
+			// Ephemeral keys, lost on restart
+			log.Warn("No KMSPath set, generating keys that will not be saved. Sessions will not survive a restart.")
+			kms = generateKMS()
+		} else if _, err := os.Stat(configPath); os.IsNotExist(err) {
 			// Generate keys
-			kms = createKMSFile(configPath)
+			kms = createKMSFile(configPath, log)
 		} else {
 			// Load keys from disk
-			kms = loadKMSFile(configPath)
+			kms = loadKMSFile(configPath, log)
 		}
 		kmsSingleton = &kms
 	})
 	return kmsSingleton
 }
 
-func createKMSFile(configPath string) (kms keyManagementStore) {
-	getLogger().Info(configPath + " not found. Generating new file.")
+func createKMSFile(configPath string, log Logger) (kms keyManagementStore) {
+	log.Info("Key file not found, generating new keys", logPath, configPath)
+	kms = generateKMS()
+	if err := writeKMSFile(configPath, kms); err != nil {
+		log.Error("Could not save generated keys", logPath, configPath, logError, err)
+		return
+	}
+	log.Info("Saved generated keys", logPath, configPath)
+	return
+}
+
+// generateKMS generates a new set of random keys.
+func generateKMS() (kms keyManagementStore) {
 	kms.CookiesHash = securecookie.GenerateRandomKey(64)
 	kms.CookiesBlock = securecookie.GenerateRandomKey(32)
-
-	jsonBody, _ := json.Marshal(kms)
-
-	// Encode to base64 and write to disk
-	jsonBody = []byte(base64.RawStdEncoding.EncodeToString(jsonBody))
-	ioutil.WriteFile(configPath, jsonBody, 0600)
-	getLogger().Info("Generated keys saved at " + configPath)
+	kms.TokenKey = securecookie.GenerateRandomKey(64)
 	return
 }
 
-func loadKMSFile(configPath string) (kms keyManagementStore) {
-	file, err := os.Open(configPath)
+// writeKMSFile encodes the keys to base64 and writes them to disk.
+func writeKMSFile(configPath string, kms keyManagementStore) error {
+	jsonBody, err := json.Marshal(kms)
 	if err != nil {
-		getLogger().Fatal("Could not open " + configPath)
+		return err
 	}
+	jsonBody = []byte(base64.RawStdEncoding.EncodeToString(jsonBody))
+	return ioutil.WriteFile(configPath, jsonBody, 0600)
+}
 
-	defer file.Close()
+// readKMSFile reads the keys written by writeKMSFile.
+func readKMSFile(configPath string) (kms keyManagementStore, err error) {
+	fileContents, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return kms, fmt.Errorf("could not open key file: %w", err)
+	}
 
 	// Decode from base64
-	fileContents, _ := ioutil.ReadAll(file)
 	fileContents, err = base64.RawStdEncoding.DecodeString(string(fileContents))
 	if err != nil {
-		getLogger().Fatal("Could not decode JSON.")
+		return kms, fmt.Errorf("could not decode key file: %w", err)
 	}
 
 	// Unmarshal into struct
-	err = json.Unmarshal(fileContents, &kms)
+	if err = json.Unmarshal(fileContents, &kms); err != nil {
+		return kms, fmt.Errorf("could not parse key file: %w", err)
+	}
+	return kms, nil
+}
+
+func loadKMSFile(configPath string, log Logger) (kms keyManagementStore) {
+	kms, err := readKMSFile(configPath)
 	if err != nil {
-		getLogger().Fatal("Could not parse config file.")
-	} else {
-		getLogger().Info("Loaded keys from " + configPath)
+		log.Error("Could not load key file", logPath, configPath, logError, err)
+		panic("authlib: " + err.Error() + ": " + configPath)
+	}
+	log.Info("Loaded keys", logPath, configPath)
+
+	// Files written before access tokens were supported have no token key.
+	// Generate one and persist it, so tokens survive a restart.
+	if len(kms.TokenKey) == 0 {
+		kms.TokenKey = securecookie.GenerateRandomKey(64)
+		if err = writeKMSFile(configPath, kms); err != nil {
+			log.Error("Could not save token signing key", logPath, configPath, logError, err)
+		} else {
+			log.Info("Added token signing key", logPath, configPath)
+		}
 	}
 
 	return
 }
+
+// GenerateKMSFile writes a new set of keys to path, in the format read by New
+// through Config.KMSPath. It fails if the file already exists.
+func GenerateKMSFile(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("key file %s already exists", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return writeKMSFile(path, generateKMS())
+}
+
+// RotateKMSFile replaces the keys in the file at path with new ones. Up to keep
+// of the sets of keys being replaced are kept, so that cookies, refresh tokens and
+// access tokens issued before the rotation are accepted until they expire; a keep
+// of 0 invalidates every session and token.
+func RotateKMSFile(path string, keep int) error {
+	old, err := readKMSFile(path)
+	if err != nil {
+		return err
+	}
+	kms := generateKMS()
+	if keep > 0 {
+		kms.Previous = append([]previousKeys{{
+			CookiesHash:  old.CookiesHash,
+			CookiesBlock: old.CookiesBlock,
+			TokenKey:     old.TokenKey,
+		}}, old.Previous...)
+		if len(kms.Previous) > keep {
+			kms.Previous = kms.Previous[:keep]
+		}
+	}
+	return writeKMSFile(path, kms)
+}
@@ -1,11 +1,46 @@
 package authlib
 
 import (
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestKMS(t *testing.T) {
-	createKMSFile(testKMSConfigPath) // Test file creation
-	loadKMSFile(testKMSConfigPath)   // Test file loading
-	getKMS(testKMSConfigPath)        // Test singleton function
+	createKMSFile(testKMSConfigPath, nopLogger{}) // Test file creation
+	loadKMSFile(testKMSConfigPath, nopLogger{})   // Test file loading
+	getKMS(testKMSConfigPath, nopLogger{})        // Test singleton function
+}
+
+func TestRotateKMSFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	assert.Empty(t, GenerateKMSFile(path), "Error generating key file")
+	assert.Error(t, GenerateKMSFile(path), "Existing key file should not be overwritten")
+
+	kms, err := readKMSFile(path)
+	assert.Empty(t, err, "Error reading generated key file")
+	encoded, err := securecookie.EncodeMulti("auth", cookieValue{
+		Key:     "user-" + string(securecookie.GenerateRandomKey(sessionKeyLength)),
+		Expires: time.Now().Add(time.Hour),
+	}, kms.codecs()...)
+	assert.Empty(t, err, "Error encoding cookie")
+
+	// Cookies encoded before a rotation can still be read
+	assert.Empty(t, RotateKMSFile(path, 1), "Error rotating key file")
+	rotated, _ := readKMSFile(path)
+	assert.NotEqual(t, kms.CookiesHash, rotated.CookiesHash, "Cookie keys should be replaced")
+	assert.NotEqual(t, kms.TokenKey, rotated.TokenKey, "Token key should be replaced")
+	assert.Len(t, rotated.Previous, 1, "Previous keys should be kept")
+	assert.Equal(t, kms.TokenKey, rotated.Previous[0].TokenKey, "Previous token key should be kept")
+	info, err := DecodeCookie(path, "auth", encoded)
+	assert.Empty(t, err, "Cookie from before rotation should be decoded")
+	assert.True(t, info.Previous, "Cookie should be reported as using previous keys")
+
+	// Only as many previous keys as asked for are kept
+	assert.Empty(t, RotateKMSFile(path, 1), "Error rotating key file again")
+	_, err = DecodeCookie(path, "auth", encoded)
+	assert.ErrorIs(t, err, ErrInvalidCookie, "Cookie from two rotations ago should be rejected")
 }
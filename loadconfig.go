@@ -0,0 +1,248 @@
+package authlib
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileSuffix marks a key whose value is read from the file at the given path,
+// so that secrets do not have to be written into the config itself.
+const fileSuffix = "_file"
+
+// LoadConfigOpts bundles the options for loading a config.
+type LoadConfigOpts struct {
+	Path      string // YAML or JSON file to read, if any
+	EnvPrefix string // Prefix of the environment variables to read, e.g. "AUTHLIB" for AUTHLIB_IDLE_TIMEOUT. Leaving it blank skips the environment.
+}
+
+// signingKeyEntry is a signing key as given in a config file.
+type signingKeyEntry struct {
+	ID        string `yaml:"id"`
+	Algorithm string `yaml:"algorithm"`
+	KeyFile   string `yaml:"key_file"` // PEM encoded private key, in PKCS #8, or PKCS #1 for RSA
+}
+
+// LoadConfig reads a config from a file and/or environment variables, using the
+// keys given by the config tags of Config. Environment variables take precedence
+// over the file, and are named after the keys in upper case, e.g. AUTHLIB_IDLE_TIMEOUT.
+// Durations are written like "1h30m". Any key can instead be given with a "_file"
+// suffix holding the path of a file to read the value from, e.g. AUTHLIB_REDIS_CONN_FILE.
+// Signing keys can only be given in the file, as a list of id, algorithm and key_file.
+//
+// The config is validated once loaded. Errors are returned as a *ConfigError naming
+// the key that was read, or the field in Config if it was not set.
+func LoadConfig(opts LoadConfigOpts) (config Config, err error) {
+	sources := make(map[string]string) // Field name in Config, to the key it was read from
+	if opts.Path != "" {
+		if err = loadConfigFile(&config, opts.Path, sources); err != nil {
+			return Config{}, err
+		}
+	}
+	if opts.EnvPrefix != "" {
+		if err = loadConfigEnv(&config, opts.EnvPrefix, sources); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if err = config.Validate(); err != nil {
+		var configErr *ConfigError
+		if errors.As(err, &configErr) {
+			// Name the key instead of the field, keeping any index
+			field, index := configErr.Field, ""
+			if i := strings.IndexByte(field, '['); i >= 0 {
+				field, index = field[:i], field[i:]
+			}
+			if key, ok := sources[field]; ok {
+				err = &ConfigError{Field: key + index, Reason: configErr.Reason}
+			}
+		}
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// configField is a field of Config that can be loaded.
+type configField struct {
+	name  string
+	key   string
+	value reflect.Value
+}
+
+// configFields lists the fields of config that have a config tag.
+func configFields(config *Config) (fields []configField) {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if key, ok := t.Field(i).Tag.Lookup("config"); ok {
+			fields = append(fields, configField{
+				name:  t.Field(i).Name,
+				key:   key,
+				value: v.Field(i),
+			})
+		}
+	}
+	return
+}
+
+func loadConfigFile(config *Config, path string, sources map[string]string) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// JSON is a subset of YAML, so both are read the same way
+	values := make(map[string]interface{})
+	if err = yaml.Unmarshal(contents, &values); err != nil {
+		return fmt.Errorf("could not parse %s: %w", path, err)
+	}
+
+	fields := make(map[string]configField)
+	for _, field := range configFields(config) {
+		fields[field.key] = field
+	}
+	for key, value := range values {
+		field, ok := fields[strings.TrimSuffix(key, fileSuffix)]
+		if !ok {
+			return &ConfigError{Field: key, Reason: "is not a known key"}
+		}
+		if field.name == "SigningKeys" {
+			if err = loadSigningKeys(config, key, value); err != nil {
+				return err
+			}
+			sources[field.name] = key
+			continue
+		}
+		switch value.(type) {
+		case string, int, int64, uint64, float64, bool:
+		default:
+			// Such as a key left empty, which would otherwise be read as "<nil>"
+			return &ConfigError{Field: key, Reason: "must be a string, number or boolean"}
+		}
+		if err = setConfigField(field, key, fmt.Sprint(value)); err != nil {
+			return err
+		}
+		sources[field.name] = key
+	}
+	return nil
+}
+
+func loadConfigEnv(config *Config, prefix string, sources map[string]string) error {
+	for _, field := range configFields(config) {
+		if field.name == "SigningKeys" {
+			continue
+		}
+		for _, key := range []string{field.key, field.key + fileSuffix} {
+			name := prefix + "_" + strings.ToUpper(key)
+			if raw, ok := os.LookupEnv(name); ok {
+				if err := setConfigField(field, name, raw); err != nil {
+					return err
+				}
+				sources[field.name] = name
+			}
+		}
+	}
+	return nil
+}
+
+// setConfigField parses raw into the field. If the key has the file suffix,
+// raw is the path of the file holding the value.
+func setConfigField(field configField, key, raw string) error {
+	if strings.HasSuffix(strings.ToLower(key), fileSuffix) {
+		contents, err := os.ReadFile(raw)
+		if err != nil {
+			return &ConfigError{Field: key, Reason: "could not be read: " + err.Error()}
+		}
+		raw = strings.TrimRight(string(contents), "\r\n")
+	}
+
+	v := field.value
+	switch v.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return &ConfigError{Field: key, Reason: "is not a duration such as \"1h30m\": " + raw}
+		}
+		v.SetInt(int64(d))
+	case string, SessionLimitPolicy:
+		v.SetString(raw)
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return &ConfigError{Field: key, Reason: "is not true or false: " + raw}
+		}
+		v.SetBool(b)
+	case uint32:
+		n, err := strconv.ParseUint(raw, 10, 32)
+		if err != nil {
+			return &ConfigError{Field: key, Reason: "is not a positive number: " + raw}
+		}
+		v.SetUint(n)
+	case int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return &ConfigError{Field: key, Reason: "is not a number: " + raw}
+		}
+		v.SetInt(int64(n))
+	default:
+		return &ConfigError{Field: key, Reason: "cannot be loaded"}
+	}
+	return nil
+}
+
+// loadSigningKeys reads the signing keys listed in a config file.
+func loadSigningKeys(config *Config, key string, value interface{}) error {
+	// Round trip through YAML to decode the entries
+	encoded, err := yaml.Marshal(value)
+	if err != nil {
+		return &ConfigError{Field: key, Reason: "could not be read: " + err.Error()}
+	}
+	var entries []signingKeyEntry
+	if err = yaml.Unmarshal(encoded, &entries); err != nil {
+		return &ConfigError{Field: key, Reason: "must be a list of id, algorithm and key_file"}
+	}
+
+	config.SigningKeys = nil
+	for i, entry := range entries {
+		signer, err := readSigningKey(entry.KeyFile)
+		if err != nil {
+			return &ConfigError{Field: fmt.Sprintf("%s[%d].key_file", key, i), Reason: err.Error()}
+		}
+		config.SigningKeys = append(config.SigningKeys, SigningKey{
+			ID:        entry.ID,
+			Algorithm: entry.Algorithm,
+			Key:       signer,
+		})
+	}
+	return nil
+}
+
+// readSigningKey reads a PEM encoded private key.
+func readSigningKey(path string) (crypto.Signer, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not be read: %w", err)
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, errors.New("is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, errors.New("is not a private key that can sign")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("is not a PKCS #8 or PKCS #1 private key")
+}
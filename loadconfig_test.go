@@ -0,0 +1,104 @@
+package authlib
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	keyPath := writeTestFile(t, "signing.pem", string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+	secretPath := writeTestFile(t, "redis", "redis://:secret@localhost:6379\n")
+
+	yamlPath := writeTestFile(t, "authlib.yaml", `
+idle_timeout: 30m
+forced_timeout: 12h
+hash_memory: 64
+cookie_secure: true
+redis_conn_file: `+secretPath+`
+signing_keys:
+  - id: "2024"
+    algorithm: EdDSA
+    key_file: `+keyPath+`
+`)
+	config, err := LoadConfig(LoadConfigOpts{Path: yamlPath})
+	assert.Empty(t, err, "Error loading YAML config")
+	assert.Equal(t, 30*time.Minute, config.IdleTimeout)
+	assert.Equal(t, 12*time.Hour, config.ForcedTimeout)
+	assert.Equal(t, uint32(64), config.HashMemory)
+	assert.True(t, config.CookieSecure)
+	assert.Equal(t, "redis://:secret@localhost:6379", config.RedisConn, "Secret was not read from its file")
+	if assert.Len(t, config.SigningKeys, 1, "Signing key was not loaded") {
+		assert.Equal(t, "2024", config.SigningKeys[0].ID)
+		assert.Equal(t, key, config.SigningKeys[0].Key)
+	}
+
+	jsonPath := writeTestFile(t, "authlib.json", `{"idle_timeout": "5m", "token_issuer": "auth"}`)
+	config, err = LoadConfig(LoadConfigOpts{Path: jsonPath})
+	assert.Empty(t, err, "Error loading JSON config")
+	assert.Equal(t, 5*time.Minute, config.IdleTimeout)
+	assert.Equal(t, "auth", config.TokenIssuer)
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	path := writeTestFile(t, "authlib.yaml", "idle_timeout: 30m\nforced_timeout: 1h\n")
+	t.Setenv("AUTHLIB_IDLE_TIMEOUT", "10m")
+	t.Setenv("AUTHLIB_MAX_CONCURRENT_HASHES", "4")
+	t.Setenv("AUTHLIB_KMS_PATH_FILE", writeTestFile(t, "kms", "/run/secrets/kms\n"))
+
+	config, err := LoadConfig(LoadConfigOpts{Path: path, EnvPrefix: "AUTHLIB"})
+	assert.Empty(t, err, "Error loading config")
+	assert.Equal(t, 10*time.Minute, config.IdleTimeout, "Environment should take precedence over the file")
+	assert.Equal(t, time.Hour, config.ForcedTimeout)
+	assert.Equal(t, 4, config.MaxConcurrentHashes)
+	assert.Equal(t, "/run/secrets/kms", config.KMSPath)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	assertKey := func(err error, key string) {
+		var configErr *ConfigError
+		if assert.True(t, errors.As(err, &configErr), "Expected a ConfigError for %s, got %v", key, err) {
+			assert.Equal(t, key, configErr.Field)
+		}
+	}
+
+	_, err := LoadConfig(LoadConfigOpts{Path: writeTestFile(t, "unknown.yaml", "idle_timeot: 1h\n")})
+	assertKey(err, "idle_timeot")
+
+	_, err = LoadConfig(LoadConfigOpts{Path: writeTestFile(t, "duration.yaml", "idle_timeout: 3600\n")})
+	assertKey(err, "idle_timeout")
+
+	// Values must be scalars
+	_, err = LoadConfig(LoadConfigOpts{Path: writeTestFile(t, "null.yaml", "redis_namespace:\n")})
+	assertKey(err, "redis_namespace")
+	_, err = LoadConfig(LoadConfigOpts{Path: writeTestFile(t, "map.yaml", "kms_path:\n  path: kms.json\n")})
+	assertKey(err, "kms_path")
+	_, err = LoadConfig(LoadConfigOpts{Path: writeTestFile(t, "list.json", `{"cookie_path": ["/"]}`)})
+	assertKey(err, "cookie_path")
+
+	// Validation errors name the key the offending value was read from
+	t.Setenv("AUTHLIB_FORCED_TIMEOUT", "1m")
+	_, err = LoadConfig(LoadConfigOpts{Path: writeTestFile(t, "invalid.yaml", "idle_timeout: 1h\n"), EnvPrefix: "AUTHLIB"})
+	assertKey(err, "idle_timeout")
+
+	_, err = LoadConfig(LoadConfigOpts{Path: writeTestFile(t, "keys.yaml", "signing_keys:\n  - id: a\n    algorithm: EdDSA\n    key_file: /nonexistent\n")})
+	assertKey(err, "signing_keys[0].key_file")
+}
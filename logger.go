@@ -1,39 +1,57 @@
 package authlib
 
 import (
-	"log"
-	"sync"
-
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 )
 
-var logger *zap.Logger
-var loggerOnce sync.Once
-
-// Get returns the singleton logger instance
-func getLogger() *zap.Logger {
-	loggerOnce.Do(func() {
-		var err error
-		logger, err = zap.Config{
-			Encoding:    "console",
-			Level:       zap.NewAtomicLevelAt(zapcore.DebugLevel),
-			OutputPaths: []string{"stdout"},
-			EncoderConfig: zapcore.EncoderConfig{
-				TimeKey:     "time",
-				EncodeTime:  zapcore.RFC3339TimeEncoder,
-				LevelKey:    "level",
-				EncodeLevel: zapcore.CapitalColorLevelEncoder,
-				MessageKey:  "message",
-				NameKey:     "name",
-				EncodeName:  zapcore.FullNameEncoder,
-			},
-		}.Build()
-		if err != nil {
-			log.Fatalln("Error loading logger:", err)
-		} else {
-			logger = logger.Named("AUTHLIB")
-		}
-	})
-	return logger
+// Logger is used by authlib to log events as a message with structured fields,
+// given as alternating keys and values. Its methods match those of *slog.Logger,
+// so one can be set in the config directly. Use ZapLogger for a *zap.Logger.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// Field keys used when logging.
+const (
+	logUserID   = "userID"
+	logFamilyID = "familyID"
+	logEvent    = "event"
+	logError    = "error"
+	logPath     = "path"
+	logRemoved  = "removed"
+	logRestored = "restored"
+	logSaved    = "saved"
+)
+
+// ZapLogger adapts a *zap.Logger to the Logger interface.
+func ZapLogger(logger *zap.Logger) Logger {
+	return zapLogger{logger.Sugar()}
+}
+
+type zapLogger struct {
+	sugar *zap.SugaredLogger
+}
+
+func (l zapLogger) Debug(msg string, args ...any) { l.sugar.Debugw(msg, args...) }
+func (l zapLogger) Info(msg string, args ...any)  { l.sugar.Infow(msg, args...) }
+func (l zapLogger) Warn(msg string, args ...any)  { l.sugar.Warnw(msg, args...) }
+func (l zapLogger) Error(msg string, args ...any) { l.sugar.Errorw(msg, args...) }
+
+// nopLogger discards everything logged to it.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// logger returns the configured logger, or one that discards everything.
+func (c Config) logger() Logger {
+	if c.Logger == nil {
+		return nopLogger{}
+	}
+	return c.Logger
 }
@@ -0,0 +1,31 @@
+//go:build go1.21
+
+package authlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	config := testObject().config
+	config.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	a := New(config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	userID := randStr(64)
+	a.AttemptLoginContext(ctx, AttemptLoginOpts{ID: userID, ProvidedPassword: randStr(64), PasswordHash: quickHash(randStr(64))})
+
+	var record map[string]interface{}
+	assert.Empty(t, json.Unmarshal(buf.Bytes(), &record), "Log was not written as JSON")
+	assert.Equal(t, "ERROR", record["level"], "Failed login logged at the wrong level")
+	assert.Equal(t, userID, record[logUserID], "User ID was not logged")
+	assert.Equal(t, context.Canceled.Error(), record[logError], "Error was not logged")
+}
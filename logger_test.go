@@ -0,0 +1,34 @@
+package authlib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestZapLoggerTokenReuse(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	config := testObject().config
+	config.Logger = ZapLogger(zap.New(core))
+	a := New(config)
+
+	userID := randStr(64)
+	key, token, err := a.generateRmbMe(context.Background(), Store{UserID: userID}, time.Minute)
+	assert.Empty(t, err, "Error generating rmb me token")
+	entry, _ := a.checkRmbMeInDB(context.Background(), cookieOpts{key: key, token: token})
+	_, _, err = a.rotateRmbMe(context.Background(), key, entry, time.Minute)
+	assert.Empty(t, err, "Error rotating rmb me token")
+	a.checkRmbMeInDB(context.Background(), cookieOpts{key: key, token: token})
+
+	reuse := logs.FilterField(zap.String(logEvent, "token_reuse")).All()
+	if assert.Len(t, reuse, 1, "Token reuse was not logged") {
+		assert.Equal(t, zapcore.WarnLevel, reuse[0].Level, "Token reuse logged at the wrong level")
+		assert.Equal(t, userID, reuse[0].ContextMap()[logUserID], "User ID was not logged")
+		assert.Equal(t, entry.FamilyID, reuse[0].ContextMap()[logFamilyID], "Family ID was not logged")
+	}
+}
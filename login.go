@@ -1,11 +1,12 @@
 package authlib
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/securecookie"
-	"github.com/opentracing/opentracing-go"
 )
 
 func (a *Object) setCookie(key, token string, w http.ResponseWriter) (err error) {
@@ -16,32 +17,141 @@ func (a *Object) setCookie(key, token string, w http.ResponseWriter) (err error)
 	return
 }
 
-func (a *Object) setInMemStore(key, hashedToken, userID string) {
-	getStore(a.config.RedisConn, a.config.RedisNamespace).set(key, storeValue{
+// setInMemStore saves a new session, enforcing MaxSessionsPerUser.
+func (a *Object) setInMemStore(ctx context.Context, key, hashedToken, userID string, method AuthMethod) error {
+	value := a.newSessionValue(hashedToken, userID, method)
+	if a.config.MaxSessionsPerUser == 0 {
+		return a.store.set(ctx, key, value)
+	}
+
+	evicted, err := a.store.setLimited(ctx, key, value, sessionLimit{
+		max:         a.config.MaxSessionsPerUser,
+		evictOldest: a.config.SessionLimitPolicy == SessionLimitEvictOldest,
+		now:         a.config.now(),
+	})
+	for _, evictedKey := range evicted {
+		a.reportEviction(ctx, userID, evictedKey, "the user logged in again with MaxSessionsPerUser sessions")
+	}
+	return err
+}
+
+// sessionEvicted is called by the map store when it evicts a session as it holds MaxStoredSessions.
+func (a *Object) sessionEvicted(key string, value storeValue) {
+	a.reportEviction(context.Background(), value.UserID, key, "the store held MaxStoredSessions sessions")
+}
+
+// reportEviction audits a session logged out to make room for another, and calls the OnSessionEvicted hooks.
+func (a *Object) reportEviction(ctx context.Context, userID, key, reason string) {
+	a.audit(ctx, nil, AuditEvent{
+		Type:      AuditSessionEvicted,
+		UserID:    userID,
+		SessionID: sessionID(key),
+		Outcome:   AuditRevoked,
+		Reason:    reason,
+	})
+	a.hooks.run(ctx, &a.hooks.onSessionEvicted, SessionInfo{UserID: userID, SessionID: sessionID(key)})
+}
+
+// newSessionValue returns the stored value of a session established now by method.
+func (a *Object) newSessionValue(hashedToken, userID string, method AuthMethod) storeValue {
+	now := a.config.now()
+	return storeValue{
 		HashedToken: hashedToken,
 		UserID:      userID,
-		Expires:     time.Now().Add(a.config.IdleTimeout),   // Logs user out if they idle for more than 1 hour
-		MaxExpiry:   time.Now().Add(a.config.ForcedTimeout), // User forced to log in after 3 days
-	})
+		Expires:     now.Add(a.config.IdleTimeout),   // Logs user out if they idle for more than 1 hour
+		MaxExpiry:   now.Add(a.config.ForcedTimeout), // User forced to log in after 3 days
+		AuthTime:    now,
+		AuthMethod:  method,
+		Origin:      method,
+	}
+}
+
+// sessionStatus describes a valid session for CheckSession.
+func (a *Object) sessionStatus(key string, value storeValue) SessionStatus {
+	now := a.config.now()
+	return SessionStatus{
+		UserID:            value.UserID,
+		SessionID:         sessionID(key),
+		Valid:             true,
+		Origin:            value.Origin,
+		AuthMethod:        value.AuthMethod,
+		AuthTime:          value.AuthTime,
+		IdleRemaining:     value.Expires.Sub(now),
+		AbsoluteRemaining: value.MaxExpiry.Sub(now),
+	}
 }
 
-func (a *Object) saveLoginInStore(userID string) (key, token string) {
-	// We prefix the key with user ID, to help with 'forget all' for Redis (can just do a wildcard search)
-	key = userID + "-" + string(securecookie.GenerateRandomKey(32))
+// newSessionKey generates the key and token of a new session for the user.
+func newSessionKey(userID string) (key, token string) {
+	// We prefix the key with user ID, so that the user can be told from the key alone
+	key = userID + "-" + string(securecookie.GenerateRandomKey(sessionKeyLength))
 	token = string(securecookie.GenerateRandomKey(256))
-	a.setInMemStore(key, quickHash(token), userID)
 	return
 }
 
-// Saves a "login" for a given user ID
-func (a *Object) saveLogin(opts saveLoginOpts) (err error) {
-	if opts.spanContext != nil {
-		span := opentracing.StartSpan("authlib-saveLogin", opentracing.ChildOf(opts.spanContext))
-		defer span.Finish()
+func (a *Object) saveLoginInStore(ctx context.Context, userID string, method AuthMethod) (key, token string, err error) {
+	key, token = newSessionKey(userID)
+	hashedToken, err := a.hashToken(ctx, token)
+	if err != nil {
+		return "", "", err
+	}
+	err = a.setInMemStore(ctx, key, hashedToken, userID, method)
+	if err != ErrTooManySessions {
+		err = storeError("save session", err)
+	}
+	return
+}
+
+// errSessionMismatch is returned when the token of an auth cookie does not match its session.
+var errSessionMismatch = &CookieError{Name: "auth", Err: errors.New("the token does not match")}
+
+// hashToken hashes a session or remember me token, recording the time taken.
+// It waits in the hashing queue like any other hash.
+func (a *Object) hashToken(ctx context.Context, token string) (hash string, err error) {
+	if err = a.hashes.acquire(ctx); err != nil {
+		return "", err
 	}
+	defer a.hashes.release()
+	defer a.metrics.observeHash(hashToken, time.Now())
+	return quickHash(token), nil
+}
+
+// verifyToken checks a session or remember me token against its hash, recording the time taken.
+func (a *Object) verifyToken(ctx context.Context, token, hash string) (match bool, err error) {
+	return a.verifyHash(ctx, verifyToken, token, hash)
+}
+
+// verifyPassword checks a password against its hash, recording the time taken.
+func (a *Object) verifyPassword(ctx context.Context, password, hash string) (match bool, err error) {
+	return a.verifyHash(ctx, verifyPassword, password, hash)
+}
+
+func (a *Object) verifyHash(ctx context.Context, operation, password, hash string) (match bool, err error) {
+	_, span := a.startSpan(ctx, "authlib-comparePw", nil)
+	defer span.end()
+
+	if err = a.hashes.acquire(ctx); err != nil {
+		span.setError(err)
+		return false, err
+	}
+	defer a.hashes.release()
+	defer a.metrics.observeHash(operation, time.Now())
+
+	match, err = comparePasswordAndHash(password, hash)
+	span.setError(err)
+	return
+}
+
+// Saves a "login" for a given user ID, returning the key of the new session
+func (a *Object) saveLogin(ctx context.Context, opts saveLoginOpts) (key string, err error) {
+	ctx, span := a.startSpan(ctx, "authlib-saveLogin", nil)
+	defer span.end()
 
 	// Generate a key and token, and save it in the database first
-	key, token := a.saveLoginInStore(opts.userID)
+	key, token, err := a.saveLoginInStore(ctx, opts.userID, opts.method)
+	if err != nil {
+		return "", err
+	}
 
 	// Build an encrypted cookie to store this key and token on the user side as well
 	err = a.setCookie(key, token, opts.w)
@@ -51,57 +161,71 @@ func (a *Object) saveLogin(opts saveLoginOpts) (err error) {
 
 	// If remember me flag is true, generate a cookie to save that credentials as well
 	if opts.rmbMe {
-		a.generateRmbMeCookie(opts.w, opts.userID)
+		err = a.generateRmbMeCookie(ctx, opts.w, opts.userID)
 	}
 	return
 }
 
 // checkValidCookie checks if a provided cookie can be found in our
-// in-mem storage, and if it has expired.
-func (a *Object) checkValidCookie(opts cookieOpts) (userID string, valid bool) {
-	var span, storeSpan opentracing.Span
-	var spanContext opentracing.SpanContext
-	if opts.spanContext != nil {
-		span = opentracing.StartSpan("authlib-checkValidCookie", opentracing.ChildOf(opts.spanContext))
-		defer span.Finish()
-		spanContext = span.Context()
-		storeSpan = opentracing.StartSpan("authlib-storeGet", opentracing.ChildOf(spanContext))
-	}
-
-	storedValue, found := a.store.get(opts.key)
-	if storeSpan != nil {
-		storeSpan.Finish()
+// in-mem storage, and if it has expired. Expired is also set if the
+// session could not be found, e.g. as it was evicted.
+// An error is only returned if the store could not be reached,
+// or the context is done. A valid session is returned as stored,
+// with its expiry extended.
+func (a *Object) checkValidCookie(ctx context.Context, opts cookieOpts) (session storeValue, valid, expired bool, err error) {
+	ctx, span := a.startSpan(ctx, "authlib-checkValidCookie", nil)
+	defer span.end()
+
+	_, storeSpan := a.startSpan(ctx, "authlib-storeGet", nil)
+	start := time.Now()
+	storedValue, found, err := a.store.get(ctx, opts.key)
+	err = storeError("get session", err)
+	storeSpan.setStoreLatency(start)
+	storeSpan.setError(err)
+	storeSpan.end()
+	if err != nil {
+		return
 	}
 	if !found {
+		expired = true
 		return
 	}
 
 	// Check if login session has expired
-	if time.Now().After(storedValue.Expires) {
+	now := a.config.now()
+	if now.After(storedValue.Expires) {
+		expired = true
 		return
 	}
 
 	// Check if the hashes match
-	match, err := ComparePasswordAndHash(ComparePasswordOpts{
-		Password:    opts.token,
-		EncodedHash: storedValue.HashedToken,
-		SpanContext: spanContext,
-	})
+	match, err := a.verifyToken(ctx, opts.token, storedValue.HashedToken)
 	if err != nil || !match {
-		return
+		return storeValue{}, false, false, err
 	}
 
 	// Update expiry details
-	if spanContext != nil {
-		updateStoreSpan := opentracing.StartSpan("authlib-storeSet", opentracing.ChildOf(spanContext))
-		defer updateStoreSpan.Finish()
+	_, storeSpan = a.startSpan(ctx, "authlib-storeSet", nil)
+	start = time.Now()
+	found, err = a.store.update(ctx, opts.key, func(value *storeValue) error {
+		value.Expires = now.Add(a.config.IdleTimeout)
+		if value.Expires.After(value.MaxExpiry) {
+			value.Expires = value.MaxExpiry
+		}
+		storedValue = *value
+		return nil
+	})
+	err = storeError("save session", err)
+	storeSpan.setStoreLatency(start)
+	storeSpan.setError(err)
+	storeSpan.end()
+	if err != nil {
+		return storeValue{}, false, false, err
 	}
-	storedValue.Expires = time.Now().Add(a.config.IdleTimeout)
-	if storedValue.Expires.After(storedValue.MaxExpiry) {
-		storedValue.Expires = storedValue.MaxExpiry
+	if !found {
+		// Logged out in the meantime
+		return storeValue{}, false, true, nil
 	}
 
-	a.store.set(opts.key, storedValue)
-
-	return storedValue.UserID, true
+	return storedValue, true, false, nil
 }
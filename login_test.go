@@ -1,16 +1,20 @@
 package authlib
 
 import (
+	"context"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestSetInMemStore(t *testing.T) {
 	key := string(securecookie.GenerateRandomKey(32))
 	token := string(securecookie.GenerateRandomKey(256))
 	userID := randStr(64)
-	testObject().setInMemStore(key, token, userID)
+	testObject().setInMemStore(context.Background(), key, token, userID, AuthPassword)
 }
 
 func TestCheckLoginCookie(t *testing.T) {
@@ -19,21 +23,21 @@ func TestCheckLoginCookie(t *testing.T) {
 	token := string(securecookie.GenerateRandomKey(256))
 	userID := randStr(64)
 	a := testObject()
-	a.setInMemStore(key, quickHash(token), userID)
+	a.setInMemStore(context.Background(), key, quickHash(token), userID, AuthPassword)
 
 	// Test for valid user
-	userFound, valid := a.checkValidCookie(cookieOpts{
+	userFound, valid, _, _ := a.checkValidCookie(context.Background(), cookieOpts{
 		key:   key,
 		token: token,
 	})
 	if !valid {
 		t.Error("Login should have been valid, but was not accepted")
-	} else if userFound != userID {
+	} else if userFound.UserID != userID {
 		t.Error("User found had a different ID from what was expected")
 	}
 
 	// Test for wrong token
-	userFound, valid = a.checkValidCookie(cookieOpts{
+	userFound, valid, _, _ = a.checkValidCookie(context.Background(), cookieOpts{
 		key:   key,
 		token: token + token,
 	})
@@ -44,5 +48,69 @@ func TestCheckLoginCookie(t *testing.T) {
 
 func TestSaveLoginInDB(t *testing.T) {
 	a := testObject()
-	a.saveLoginInStore("1")
+	a.saveLoginInStore(context.Background(), "1", AuthPassword)
+}
+
+func TestMaxSessionsPerUser(t *testing.T) {
+	audit := &MemoryAuditSink{}
+	clock := newTestClock()
+	config := testObject().config
+	config.Clock = clock
+	config.MaxSessionsPerUser = 2
+	config.SessionLimitPolicy = SessionLimitReject
+	config.AuditSink = audit
+	a := New(config)
+	ctx := context.Background()
+
+	userID := randStr(64)
+	first, _, err := a.saveLoginInStore(ctx, userID, AuthPassword)
+	assert.Empty(t, err, "Error saving first session")
+	clock.advance(time.Second)
+	_, _, err = a.saveLoginInStore(ctx, userID, AuthPassword)
+	assert.Empty(t, err, "Error saving second session")
+	ok, err := a.loginWithoutPassword(ctx, loginOpts{HTTPWriter: httptest.NewRecorder(), ID: userID})
+	assert.False(t, ok, "Login over the limit should be rejected")
+	assert.ErrorIs(t, err, ErrTooManySessions, "Session limit should be reported")
+
+	a.config.SessionLimitPolicy = SessionLimitEvictOldest
+	ok, _ = a.loginWithoutPassword(ctx, loginOpts{HTTPWriter: httptest.NewRecorder(), ID: userID})
+	assert.True(t, ok, "Login should evict the oldest session")
+	_, found, _ := a.store.get(ctx, first)
+	assert.False(t, found, "Oldest session should be evicted")
+	events := audit.Events()
+	assert.Equal(t, AuditSessionEvicted, events[len(events)-2].Type, "Eviction should be audited")
+	assert.Equal(t, sessionID(first), events[len(events)-2].SessionID, "Evicted session should be named")
+}
+
+func TestMaxStoredSessions(t *testing.T) {
+	audit := &MemoryAuditSink{}
+	config := testObject().config
+	config.AuditSink = audit
+	a := New(config)
+	// The store is shared by every Object, so bound a store of its own
+	store := newMapStore(1)
+	store.setCapacity(1, a.sessionEvicted)
+	a.store = store
+	var evicted []SessionInfo
+	a.OnSessionEvicted(func(ctx context.Context, session SessionInfo) { evicted = append(evicted, session) })
+	ctx := context.Background()
+
+	firstUser := randStr(64)
+	first, _, err := a.saveLoginInStore(ctx, firstUser, AuthPassword)
+	assert.Empty(t, err, "Error saving first session")
+	_, _, err = a.saveLoginInStore(ctx, randStr(64), AuthPassword)
+	assert.Empty(t, err, "Error saving second session")
+
+	_, found, _ := a.store.get(ctx, first)
+	assert.False(t, found, "First session should be evicted")
+	if assert.Len(t, evicted, 1, "OnSessionEvicted should be called") {
+		assert.Equal(t, firstUser, evicted[0].UserID, "Hook should be given the evicted user")
+		assert.Equal(t, sessionID(first), evicted[0].SessionID, "Hook should be given the evicted session")
+	}
+	events := audit.Events()
+	if assert.NotEmpty(t, events, "Eviction should be audited") {
+		assert.Equal(t, AuditSessionEvicted, events[0].Type, "Eviction should be audited")
+		assert.Equal(t, AuditRevoked, events[0].Outcome, "Eviction should be a revocation")
+	}
+	assert.Equal(t, uint64(1), a.StoreStats().CapacityEvictions, "Eviction should be counted")
 }
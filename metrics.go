@@ -0,0 +1,124 @@
+package authlib
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Outcomes of AttemptLogin, used as the "outcome" label.
+const (
+	loginSuccess       = "success"
+	loginWrongPassword = "wrong_password"
+	loginError         = "error"
+	loginLocked        = "locked"        // Rejected by a BeforeLogin hook before the password was checked
+	loginSessionLimit  = "session_limit" // Rejected as the user has too many sessions
+)
+
+// Outcomes of CheckLogin, used as the "outcome" label.
+const (
+	checkValid   = "valid"
+	checkMissing = "missing" // No auth cookie was sent
+	checkExpired = "expired" // The session has expired or no longer exists, and there was no remember me cookie
+	checkRmbMe   = "rmbme"   // The session was resurrected with a remember me cookie
+	checkInvalid = "invalid" // The cookie or token was manipulated, or a remember me token was rejected
+	checkError   = "error"
+)
+
+// Hashing operations, used as the "operation" label.
+const (
+	hashPassword   = "password_hash"
+	verifyPassword = "password_verify"
+	hashToken      = "token_hash"
+	verifyToken    = "token_verify"
+)
+
+// metrics holds the Prometheus collectors updated by an Object.
+type metrics struct {
+	logins  *prometheus.CounterVec
+	checks  *prometheus.CounterVec
+	hashing *prometheus.HistogramVec
+}
+
+// newMetrics creates the collectors and registers them with the given registerer, if any.
+// Collectors that have already been registered by another Object are reused.
+func newMetrics(reg prometheus.Registerer, store storeInterface) *metrics {
+	m := &metrics{
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "authlib",
+			Name:      "login_attempts_total",
+			Help:      "Number of AttemptLogin calls, by outcome.",
+		}, []string{"outcome"}),
+		checks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "authlib",
+			Name:      "login_checks_total",
+			Help:      "Number of CheckLogin calls, by outcome.",
+		}, []string{"outcome"}),
+		hashing: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "authlib",
+			Name:      "hash_duration_seconds",
+			Help:      "Time taken to compute or verify argon2 hashes, by operation.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 10),
+		}, []string{"operation"}),
+	}
+	sessions := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "authlib",
+		Name:      "sessions",
+		Help:      "Number of sessions held in the session store.",
+	}, func() float64 { return float64(store.stats().Sessions) })
+	evictions := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "authlib",
+		Name:      "session_evictions_total",
+		Help:      "Number of expired sessions evicted from the session store.",
+	}, func() float64 { return float64(store.stats().Evictions) })
+	capacityEvictions := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "authlib",
+		Name:      "session_capacity_evictions_total",
+		Help:      "Number of sessions evicted from the session store before they expired, to stay within MaxStoredSessions.",
+	}, func() float64 { return float64(store.stats().CapacityEvictions) })
+
+	// Initialise every label, so that outcomes that have not happened yet are reported as 0
+	for _, outcome := range []string{loginSuccess, loginWrongPassword, loginError, loginLocked, loginSessionLimit} {
+		m.logins.WithLabelValues(outcome)
+	}
+	for _, outcome := range []string{checkValid, checkMissing, checkExpired, checkRmbMe, checkInvalid, checkError} {
+		m.checks.WithLabelValues(outcome)
+	}
+
+	if reg != nil {
+		m.logins = registerCollector(reg, m.logins).(*prometheus.CounterVec)
+		m.checks = registerCollector(reg, m.checks).(*prometheus.CounterVec)
+		m.hashing = registerCollector(reg, m.hashing).(*prometheus.HistogramVec)
+		if _, ok := store.(redisStore); !ok {
+			// Redis does not count its sessions
+			registerCollector(reg, sessions)
+		}
+		registerCollector(reg, evictions)
+		registerCollector(reg, capacityEvictions)
+	}
+	return m
+}
+
+// registerCollector registers c, returning the existing collector instead
+// if an identical one has already been registered.
+func registerCollector(reg prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if err := reg.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+	}
+	return c
+}
+
+func (m *metrics) login(outcome string) {
+	m.logins.WithLabelValues(outcome).Inc()
+}
+
+func (m *metrics) check(outcome string) {
+	m.checks.WithLabelValues(outcome).Inc()
+}
+
+// observeHash records the time taken by a hashing operation that began at start.
+func (m *metrics) observeHash(operation string, start time.Time) {
+	m.hashing.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
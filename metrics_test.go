@@ -0,0 +1,55 @@
+package authlib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	config := testObject().config
+	config.MetricsRegisterer = registry
+	a := New(config)
+
+	pw := randStr(64)
+	hashedPw := a.HashPassword(HashPasswordOpts{Password: pw})
+	recorder := httptest.NewRecorder()
+	a.AttemptLogin(AttemptLoginOpts{HTTPWriter: recorder, ID: randStr(64), ProvidedPassword: pw, PasswordHash: hashedPw})
+	a.AttemptLogin(AttemptLoginOpts{HTTPWriter: httptest.NewRecorder(), ID: randStr(64), ProvidedPassword: pw + pw, PasswordHash: hashedPw})
+
+	a.CheckLogin(HTTPOpts{
+		HTTPWriter:  httptest.NewRecorder(),
+		HTTPRequest: &http.Request{Header: http.Header{"Cookie": recorder.HeaderMap["Set-Cookie"]}},
+	})
+	a.CheckLogin(HTTPOpts{HTTPWriter: httptest.NewRecorder(), HTTPRequest: &http.Request{}})
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(a.metrics.logins.WithLabelValues(loginSuccess)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(a.metrics.logins.WithLabelValues(loginWrongPassword)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(a.metrics.logins.WithLabelValues(loginError)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(a.metrics.checks.WithLabelValues(checkValid)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(a.metrics.checks.WithLabelValues(checkMissing)))
+
+	count, err := testutil.GatherAndCount(registry, "authlib_hash_duration_seconds", "authlib_sessions", "authlib_session_evictions_total")
+	assert.Empty(t, err, "Error gathering metrics")
+	assert.Equal(t, 6, count, "Expected 4 hashing operations, the session gauge and the eviction counter")
+
+	// A second Object sharing the registerer reuses the registered collectors
+	b := New(config)
+	b.AttemptLogin(AttemptLoginOpts{HTTPWriter: httptest.NewRecorder(), ID: randStr(64), ProvidedPassword: pw, PasswordHash: hashedPw})
+	assert.Equal(t, 2.0, testutil.ToFloat64(a.metrics.logins.WithLabelValues(loginSuccess)))
+}
+
+func TestMetricsRedis(t *testing.T) {
+	store, _ := testRedisStore(t)
+	registry := prometheus.NewRegistry()
+	newMetrics(registry, store)
+
+	count, err := testutil.GatherAndCount(registry, "authlib_sessions", "authlib_session_evictions_total")
+	assert.Empty(t, err, "Error gathering metrics")
+	assert.Equal(t, 1, count, "Session gauge should not be exported for Redis, which does not count its sessions")
+}
@@ -0,0 +1,75 @@
+package authlib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// sessionContextKey is the key of the Session in a request context.
+type sessionContextKey struct{}
+
+// RequireLogin is middleware checking each request with CheckLogin. Requests with a valid
+// login are passed on to next, with their Session in the request context. Others are
+// rejected with 401 Unauthorized, or 503 Service Unavailable if the store could not be reached.
+func (a *Object) RequireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, key, err := a.checkSession(r.Context(), HTTPOpts{
+			HTTPWriter:  w,
+			HTTPRequest: r,
+		})
+		if !status.Valid {
+			status := http.StatusUnauthorized
+			if errors.Is(err, ErrStoreUnavailable) {
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+
+		session := &Session{
+			UserID:    status.UserID,
+			SessionID: status.SessionID,
+			a:         a,
+			key:       key,
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, session)))
+	})
+}
+
+// RequireRecentAuth returns middleware requiring the user to have authenticated within
+// maxAge, e.g. through Reauthenticate, before sensitive actions such as deleting their
+// account. It must be wrapped by RequireLogin. Sessions resurrected from a remember me
+// cookie only count once the user has reauthenticated. Requests without a session are
+// rejected with 401 Unauthorized, and those without a recent enough authentication with
+// 403 Forbidden, upon which the app should ask for the user's password again.
+func (a *Object) RequireRecentAuth(maxAge time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session := SessionFromContext(r.Context())
+			if session == nil {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			recent, err := session.authenticatedWithin(r.Context(), maxAge)
+			switch {
+			case errors.Is(err, ErrStoreUnavailable):
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			case err != nil:
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			case !recent:
+				http.Error(w, "Reauthentication required", http.StatusForbidden)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// SessionFromContext returns the session put in the request context by RequireLogin,
+// or nil if there is none.
+func SessionFromContext(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionContextKey{}).(*Session)
+	return session
+}
@@ -0,0 +1,36 @@
+package authlib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireLogin(t *testing.T) {
+	a := testObject()
+	var session *Session
+	handler := a.RequireLogin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session = SessionFromContext(r.Context())
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code, "Request without a login should be rejected")
+	assert.Nil(t, session, "Handler should not be called")
+
+	userID := randStr(64)
+	login := httptest.NewRecorder()
+	key, _ := a.saveLogin(context.Background(), saveLoginOpts{w: login, userID: userID})
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header["Cookie"] = login.Result().Header["Set-Cookie"]
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code, "Request with a login should be accepted")
+	if assert.NotNil(t, session, "Session should be in the context") {
+		assert.Equal(t, userID, session.UserID, "Session belongs to the wrong user")
+		assert.Equal(t, sessionID(key), session.SessionID, "Wrong session ID")
+	}
+}
@@ -0,0 +1,142 @@
+package authlib
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// AuthMethod says how a user authenticated.
+type AuthMethod string
+
+// Ways a user can authenticate.
+const (
+	AuthPassword AuthMethod = "password" // AttemptLogin or Reauthenticate
+	AuthMFA      AuthMethod = "mfa"      // A second factor checked by the app, recorded with Session.SetAuthenticated
+	AuthRmbMe    AuthMethod = "rmbme"    // A session resurrected from a remember me cookie, without the user entering anything
+	AuthExternal AuthMethod = "external" // Checked outside authlib, e.g. single sign-on, or a login by authlibtest
+)
+
+// Reauthenticate checks the password of a logged in user again, e.g. before they change
+// their email, and records it on their session for RequireRecentAuth. Unlike AttemptLogin,
+// no new session is created.
+// ok = true: Reauthenticated
+// ok = false, err = ErrWrongPassword: Wrong password
+// ok = false, err = http.ErrNoCookie or ErrSessionExpired: The user is not logged in
+// ok = false, other err: An error occurred, e.g. ErrInvalidCookie or ErrStoreUnavailable
+func (a *Object) Reauthenticate(opts ReauthenticateOpts) (ok bool, err error) {
+	return a.ReauthenticateContext(contextOf(HTTPOpts{HTTPRequest: opts.HTTPRequest}), opts)
+}
+
+// ReauthenticateContext is Reauthenticate, traced as a child of the span in ctx.
+func (a *Object) ReauthenticateContext(ctx context.Context, opts ReauthenticateOpts) (ok bool, err error) {
+	ctx, span := a.startSpan(ctx, "authlib-reauthenticate", nil)
+	defer span.end()
+
+	session, err := a.sessionOf(ctx, opts.HTTPRequest)
+	if err != nil {
+		span.setError(err)
+		return false, err
+	}
+	span.setUserID(session.UserID)
+
+	match, err := a.verifyPassword(ctx, opts.ProvidedPassword, opts.PasswordHash)
+	if err == nil && !match {
+		err = ErrWrongPassword
+	}
+	if err == nil {
+		err = session.SetAuthenticated(ctx, AuthPassword)
+		ok = (err == nil)
+	}
+
+	outcome := AuditSuccess
+	switch {
+	case err == ErrWrongPassword:
+		outcome = loginWrongPassword
+	case err != nil:
+		outcome = AuditError
+		span.setError(err)
+	}
+	span.setOutcome(outcome)
+	a.audit(ctx, opts.HTTPRequest, AuditEvent{
+		Type:      AuditReauthenticate,
+		UserID:    session.UserID,
+		SessionID: session.SessionID,
+		Outcome:   outcome,
+		Reason:    errorReason(err),
+	})
+	return
+}
+
+// sessionOf returns the session of the auth cookie sent with r, if it is valid,
+// extending its idle timeout. Returns http.ErrNoCookie if no auth cookie was sent,
+// and ErrSessionExpired if the session has expired or was logged out.
+func (a *Object) sessionOf(ctx context.Context, r *http.Request) (*Session, error) {
+	cookieObj, err := a.sc.Get(r, "auth")
+	if err != nil {
+		return nil, err
+	}
+	value, valid, expired, err := a.checkValidCookie(ctx, cookieOpts{
+		key:   cookieObj.Key,
+		token: cookieObj.Token,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		if expired {
+			return nil, ErrSessionExpired
+		}
+		return nil, errSessionMismatch
+	}
+	return &Session{
+		UserID:    value.UserID,
+		SessionID: sessionID(cookieObj.Key),
+		a:         a,
+		key:       cookieObj.Key,
+	}, nil
+}
+
+// SetAuthenticated records that the user has just authenticated by method, e.g. AuthMFA
+// once the app has checked a one-time code, for RequireRecentAuth.
+func (s *Session) SetAuthenticated(ctx context.Context, method AuthMethod) error {
+	now := s.a.config.now()
+	found, err := s.a.store.update(ctx, s.key, func(value *storeValue) error {
+		value.AuthTime = now
+		value.AuthMethod = method
+		return nil
+	})
+	if err = storeError("save session", err); err != nil {
+		return err
+	}
+	if !found {
+		return ErrSessionExpired
+	}
+	return nil
+}
+
+// LastAuth returns when and how the user last authenticated in this session,
+// by logging in or reauthenticating.
+func (s *Session) LastAuth(ctx context.Context) (at time.Time, method AuthMethod, err error) {
+	value, found, err := s.a.store.get(ctx, s.key)
+	if err = storeError("get session", err); err != nil {
+		return
+	}
+	if !found {
+		return at, method, ErrSessionExpired
+	}
+	return value.AuthTime, value.AuthMethod, nil
+}
+
+// authenticatedWithin reports whether the user entered their credentials within maxAge.
+// Sessions resurrected from a remember me cookie do not count until reauthenticated.
+func (s *Session) authenticatedWithin(ctx context.Context, maxAge time.Duration) (bool, error) {
+	at, method, err := s.LastAuth(ctx)
+	if err != nil {
+		return false, err
+	}
+	if at.IsZero() || method == AuthRmbMe {
+		return false, nil
+	}
+	return s.a.config.now().Sub(at) <= maxAge, nil
+}
@@ -0,0 +1,80 @@
+package authlib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReauthenticate(t *testing.T) {
+	clock := newTestClock()
+	config := testObject().config
+	config.Clock = clock
+	config.IdleTimeout = time.Minute
+	a := New(config)
+
+	pw := randStr(16)
+	hash := quickHash(pw)
+	login := httptest.NewRecorder()
+	ok, _ := a.AttemptLogin(AttemptLoginOpts{HTTPWriter: login, ID: randStr(64), ProvidedPassword: pw, PasswordHash: hash})
+	assert.True(t, ok, "Login was not accepted")
+	newRequest := func() *http.Request {
+		request := httptest.NewRequest(http.MethodPost, "/account/delete", nil)
+		request.Header["Cookie"] = login.Result().Header["Set-Cookie"]
+		return request
+	}
+
+	handler := a.RequireLogin(a.RequireRecentAuth(30 * time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	serve := func() int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newRequest())
+		return recorder.Code
+	}
+	assert.Equal(t, http.StatusOK, serve(), "Fresh login should count as recent")
+
+	clock.advance(40 * time.Second)
+	assert.Equal(t, http.StatusForbidden, serve(), "Old login should not count as recent")
+
+	ok, err := a.Reauthenticate(ReauthenticateOpts{HTTPRequest: newRequest(), ProvidedPassword: randStr(16), PasswordHash: hash})
+	assert.False(t, ok, "Wrong password should not be accepted")
+	assert.ErrorIs(t, err, ErrWrongPassword, "Wrong password should be reported")
+	assert.Equal(t, http.StatusForbidden, serve(), "Failed reauthentication should not count")
+
+	ok, err = a.Reauthenticate(ReauthenticateOpts{HTTPRequest: newRequest(), ProvidedPassword: pw, PasswordHash: hash})
+	assert.True(t, ok, "Reauthentication was not accepted")
+	assert.Empty(t, err, "An error occurred while reauthenticating")
+	assert.Equal(t, http.StatusOK, serve(), "Reauthentication should count as recent")
+
+	session, _ := a.sessionOf(context.Background(), newRequest())
+	at, method, _ := session.LastAuth(context.Background())
+	assert.Equal(t, clock.Now(), at, "Wrong time of authentication")
+	assert.Equal(t, AuthPassword, method, "Wrong method of authentication")
+
+	_, err = a.Reauthenticate(ReauthenticateOpts{HTTPRequest: httptest.NewRequest(http.MethodPost, "/", nil), ProvidedPassword: pw, PasswordHash: hash})
+	assert.ErrorIs(t, err, http.ErrNoCookie, "Reauthentication without a session should be rejected")
+}
+
+func TestRecentAuthMethods(t *testing.T) {
+	a := testObject()
+	ctx := context.Background()
+
+	login := httptest.NewRecorder()
+	a.loginWithoutPassword(ctx, loginOpts{HTTPWriter: login, ID: randStr(64)})
+	request := &http.Request{Header: http.Header{"Cookie": login.Result().Header["Set-Cookie"]}}
+	session, err := a.sessionOf(ctx, request)
+	assert.Empty(t, err, "Session from loginWithoutPassword should be valid")
+	_, method, _ := session.LastAuth(ctx)
+	assert.Equal(t, AuthExternal, method, "loginWithoutPassword should be recorded as external")
+
+	// Resurrected sessions are not recent until the user reauthenticates
+	assert.Empty(t, session.SetAuthenticated(ctx, AuthRmbMe), "Error recording authentication")
+	recent, _ := session.authenticatedWithin(ctx, time.Hour)
+	assert.False(t, recent, "Remember me should not count as recent")
+	session.SetAuthenticated(ctx, AuthMFA)
+	recent, _ = session.authenticatedWithin(ctx, time.Hour)
+	assert.True(t, recent, "MFA should count as recent")
+}
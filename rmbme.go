@@ -1,75 +1,239 @@
 package authlib
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/securecookie"
 )
 
+var (
+	errInvalidRmbMe = &CookieError{Name: "rmbme", Err: errors.New("the token does not match")}
+	errRmbMeExpired = fmt.Errorf("%w: the remember me token has expired", ErrSessionExpired)
+)
+
 // Generate a random key and token, and store it to the database first.
-func (a *Object) generateRmbMe(userID string) (key, token string, err error) {
+// The family gives the user ID, and the family ID and expiry the token belongs to.
+// An empty family ID starts a new token family.
+func (a *Object) generateRmbMe(ctx context.Context, family Store, lifetime time.Duration) (key, token string, err error) {
+	key, token, entry, err := a.newRmbMe(ctx, family, lifetime)
+	if err != nil {
+		return "", "", err
+	}
+	err = storeError("insert remember me token", a.db.Insert(ctx, key, entry))
+	return
+}
+
+// newRmbMe generates a random key and token in the given family, returning
+// the entry to store for them.
+func (a *Object) newRmbMe(ctx context.Context, family Store, lifetime time.Duration) (key, token string, entry Store, err error) {
+	now := a.config.now()
+	if family.FamilyID == "" {
+		family.FamilyID = base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(16))
+		if a.config.RmbMeMaxLifetime > 0 {
+			family.FamilyExpires = now.Add(a.config.RmbMeMaxLifetime)
+		}
+	}
+
+	expires := now.Add(lifetime)
+	if !family.FamilyExpires.IsZero() && expires.After(family.FamilyExpires) {
+		expires = family.FamilyExpires
+	}
+
 	key = string(securecookie.GenerateRandomKey(64))
 	token = string(securecookie.GenerateRandomKey(512))
-	err = a.db.Insert(key, quickHash(token), userID)
+	tokenHash, err := a.hashToken(ctx, token)
+	if err != nil {
+		return "", "", Store{}, err
+	}
+	entry = Store{
+		UserID:        family.UserID,
+		TokenHash:     tokenHash,
+		FamilyID:      family.FamilyID,
+		IssuedAt:      now,
+		Expires:       expires,
+		FamilyExpires: family.FamilyExpires,
+	}
 	return
 }
 
 // Checks if a given cookie payload (token & key) matches what we have in the database.
-func (a *Object) checkRmbMeInDB(cookieOptsValue cookieOpts) (userID string, err error) {
-	var storedHash string
-	userID, storedHash, err = a.db.Fetch(cookieOptsValue.key)
-	if err != nil || userID == "" {
+// A valid token that has already been rotated can only be presented by someone holding
+// a copy of an old token, so the whole family is revoked, and the entry is returned
+// along with ErrTokenReuse. If no entry is found, the returned entry will have an empty user ID.
+func (a *Object) checkRmbMeInDB(ctx context.Context, cookieOptsValue cookieOpts) (entry Store, err error) {
+	entry, err = a.db.Fetch(ctx, cookieOptsValue.key)
+	if err = storeError("fetch remember me token", err); err != nil || entry.UserID == "" {
 		// Either an error occurred, or no user was found
 		return
 	}
 
-	match, err := ComparePasswordAndHash(ComparePasswordOpts{
-		Password:    cookieOptsValue.token,
-		EncodedHash: storedHash,
-	})
-
+	match, err := a.verifyToken(ctx, cookieOptsValue.token, entry.TokenHash)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return Store{}, ctxErr
+	}
 	if err != nil || !match {
 		// Invalidate database entry
-		err = errors.New("Invalid token value")
-		a.db.RemoveSingle(cookieOptsValue.key)
-		return
+		a.db.RemoveSingle(ctx, cookieOptsValue.key)
+		return Store{}, errInvalidRmbMe
 	}
-	return
+
+	if entry.Rotated {
+		return entry, a.revokeReusedToken(ctx, entry)
+	}
+
+	if a.config.now().After(entry.Expires) {
+		a.db.RemoveSingle(ctx, cookieOptsValue.key)
+		return Store{}, errRmbMeExpired
+	}
+	return entry, nil
 }
 
-func (a *Object) generateRmbMeCookie(w http.ResponseWriter, userID string) error {
-	key, token, err := a.generateRmbMe(userID) // Generate key & token, and store to database
+// rotateRmbMe marks a token as used, and issues its replacement in the same family.
+// If the token was rotated in the meantime, e.g. by a concurrent request replaying
+// it, its family is revoked and ErrTokenReuse is returned.
+func (a *Object) rotateRmbMe(ctx context.Context, key string, entry Store, lifetime time.Duration) (newKey, newToken string, err error) {
+	newKey, newToken, newEntry, err := a.newRmbMe(ctx, entry, lifetime)
 	if err != nil {
+		return "", "", err
+	}
+	found, err := a.claimToken(ctx, key, newKey, newEntry)
+	if err != nil {
+		return "", "", err
+	}
+	if !found {
+		// Revoked in the meantime
+		return "", "", errInvalidRmbMe
+	}
+	return
+}
+
+// claimToken marks a remember me or refresh token as rotated, storing its replacement
+// in the same step, and reports whether it was found. A token that was already rotated
+// has been presented twice, so its family is revoked, and ErrTokenReuse is returned.
+func (a *Object) claimToken(ctx context.Context, key, newKey string, newEntry Store) (found bool, err error) {
+	entry, alreadyRotated, err := a.db.Rotate(ctx, key, newKey, newEntry)
+	if err = storeError("rotate token", err); err != nil {
+		return false, err
+	}
+	if alreadyRotated {
+		return true, a.revokeReusedToken(ctx, entry)
+	}
+	return entry.UserID != "", nil
+}
+
+// revokeReusedToken revokes the family of a rotated token that was presented again,
+// as only someone holding a copy of an old token can present it. It returns
+// ErrTokenReuse, or the error from the database if the family could not be revoked.
+// Callers audit the reuse, as they know the request it came from.
+func (a *Object) revokeReusedToken(ctx context.Context, entry Store) error {
+	a.config.logger().Warn("Rotated token reused, revoking token family",
+		logEvent, "token_reuse",
+		logUserID, entry.UserID,
+		logFamilyID, entry.FamilyID,
+	)
+	if err := storeError("revoke remember me tokens", a.db.RemoveFamily(ctx, entry.FamilyID)); err != nil {
 		return err
 	}
+	return ErrTokenReuse
+}
 
-	// Then take resulting values to save as secure cookie
+// allowFamilyLogin calls the BeforeLogin hooks for a user logging in again with a
+// remember me or refresh token. If a hook rejects the login, the token's family is
+// revoked so that it cannot be used again, the rejection is audited as an event of
+// the given type, and the hook's error is returned.
+func (a *Object) allowFamilyLogin(ctx context.Context, r *http.Request, entry Store, eventType AuditEventType) error {
+	err := a.hooks.runBeforeLogin(ctx, SessionInfo{UserID: entry.UserID, Request: r})
+	if err == nil {
+		return nil
+	}
+	if revokeErr := storeError("revoke remember me tokens", a.db.RemoveFamily(ctx, entry.FamilyID)); revokeErr != nil {
+		a.config.logger().Error("Could not revoke the tokens of a rejected login", logUserID, entry.UserID, logError, revokeErr)
+	}
+	a.audit(ctx, r, AuditEvent{
+		Type:    eventType,
+		UserID:  entry.UserID,
+		Outcome: loginLocked,
+		Reason:  errorReason(err),
+	})
+	return err
+}
+
+// revokeRmbMe removes the token family that a key belongs to, returning the entry of the key.
+func (a *Object) revokeRmbMe(ctx context.Context, key string) (entry Store, err error) {
+	entry, err = a.db.Fetch(ctx, key)
+	if err = storeError("fetch remember me token", err); err != nil || entry.FamilyID == "" {
+		return
+	}
+	return entry, storeError("revoke remember me tokens", a.db.RemoveFamily(ctx, entry.FamilyID))
+}
+
+// setRmbMeCookie saves a remember me key and token as a secure cookie.
+// The cookie does not outlive the token's family.
+func (a *Object) setRmbMeCookie(w http.ResponseWriter, key, token string, familyExpires time.Time) error {
+	maxAge := a.config.RmbMeTimeout
+	if !familyExpires.IsZero() {
+		if remaining := familyExpires.Sub(a.config.now()); remaining < maxAge {
+			maxAge = remaining
+		}
+	}
 	return a.sc.Set(w, "rmbme", cookieValue{
 		Key:   key,
 		Token: token,
-	}, a.config.RmbMeTimeout)
+	}, maxAge)
 }
 
-func (a *Object) checkRmbMeCookie(opts HTTPOpts) (userID string, err error) {
+func (a *Object) generateRmbMeCookie(ctx context.Context, w http.ResponseWriter, userID string) error {
+	key, token, entry, err := a.newRmbMe(ctx, Store{UserID: userID}, a.config.RmbMeTimeout) // Generate key & token, and store to database
+	if err != nil {
+		return err
+	}
+	if err = storeError("insert remember me token", a.db.Insert(ctx, key, entry)); err != nil {
+		return err
+	}
+
+	// Then take resulting values to save as secure cookie
+	return a.setRmbMeCookie(w, key, token, entry.FamilyExpires)
+}
+
+// checkRmbMeCookie validates the remember me cookie, if any, and rotates it.
+// The caller is responsible for creating the new login session.
+// If a BeforeLogin hook rejects the login, the user ID is returned along with the hook's error.
+// If a rotated cookie is reused, the user ID is returned along with ErrTokenReuse.
+func (a *Object) checkRmbMeCookie(ctx context.Context, opts HTTPOpts) (userID string, err error) {
+	ctx, span := a.startSpan(ctx, "authlib-checkRmbMeCookie", nil)
+	defer span.end()
+
 	cookieObj, err := a.sc.Get(opts.HTTPRequest, "rmbme")
 	if err == nil {
-		userID, err = a.checkRmbMeInDB(cookieOpts{
-			key:         cookieObj.Key,
-			token:       cookieObj.Token,
-			spanContext: opts.SpanContext,
+		var entry Store
+		entry, err = a.checkRmbMeInDB(ctx, cookieOpts{
+			key:   cookieObj.Key,
+			token: cookieObj.Token,
 		})
+		if err == nil && entry.UserID == "" {
+			err = errInvalidRmbMe
+		}
 		if err == nil {
+			err = a.allowFamilyLogin(ctx, opts.HTTPRequest, entry, AuditRmbMeLogin)
+			if err != nil {
+				return entry.UserID, err
+			}
 			// Valid rmb me token
-			err = a.saveLogin(saveLoginOpts{
-				userID: userID,
-				rmbMe:  true,
-				w:      opts.HTTPWriter,
-			})
+			var key, token string
+			key, token, err = a.rotateRmbMe(ctx, cookieObj.Key, entry, a.config.RmbMeTimeout)
 			if err == nil {
-				a.generateRmbMeCookie(opts.HTTPWriter, userID)
+				err = a.setRmbMeCookie(opts.HTTPWriter, key, token, entry.FamilyExpires)
 			}
 		}
+		if err == nil || err == ErrTokenReuse {
+			// On reuse, returned for auditing, but not accepted
+			userID = entry.UserID
+		}
 	}
 	return
 }
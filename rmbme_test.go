@@ -1,7 +1,12 @@
 package authlib
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -10,19 +15,159 @@ func TestGenerateRmbMe(t *testing.T) {
 	userID := randStr(64)
 	a := testObject()
 
-	key, token, err := a.generateRmbMe(userID)
+	key, token, err := a.generateRmbMe(context.Background(), Store{UserID: userID}, time.Minute)
 	assert.Empty(t, err, "Error generating rmb me token")
 
-	userIDFound, err := a.checkRmbMeInDB(cookieOpts{
+	entry, err := a.checkRmbMeInDB(context.Background(), cookieOpts{
 		key:   key,
 		token: token,
 	})
 	assert.Empty(t, err, "Error checking rmb me in db")
-	assert.Equal(t, userID, userIDFound, "Wrong user ID retrieved")
+	assert.Equal(t, userID, entry.UserID, "Wrong user ID retrieved")
+	assert.NotEmpty(t, entry.FamilyID, "Token was not assigned a family")
 
-	_, err = a.checkRmbMeInDB(cookieOpts{
+	_, err = a.checkRmbMeInDB(context.Background(), cookieOpts{
 		key:   key,
 		token: token + token,
 	})
 	assert.NotEmpty(t, err, "Should have invalidated with wrong token")
 }
+
+func TestRotatedRmbMeReuse(t *testing.T) {
+	userID := randStr(64)
+	a := testObject()
+
+	key, token, err := a.generateRmbMe(context.Background(), Store{UserID: userID}, time.Minute)
+	assert.Empty(t, err, "Error generating rmb me token")
+	entry, _ := a.checkRmbMeInDB(context.Background(), cookieOpts{key: key, token: token})
+
+	newKey, newToken, err := a.rotateRmbMe(context.Background(), key, entry, time.Minute)
+	assert.Empty(t, err, "Error rotating rmb me token")
+	entry, err = a.checkRmbMeInDB(context.Background(), cookieOpts{key: newKey, token: newToken})
+	assert.Empty(t, err, "Rotated token should be valid")
+	assert.Equal(t, userID, entry.UserID, "Wrong user ID retrieved")
+
+	// Replaying the old token revokes the whole family, including the new token
+	_, err = a.checkRmbMeInDB(context.Background(), cookieOpts{key: key, token: token})
+	assert.Equal(t, ErrTokenReuse, err, "Reuse of rotated token should have been detected")
+	entry, _ = a.checkRmbMeInDB(context.Background(), cookieOpts{key: newKey, token: newToken})
+	assert.Empty(t, entry.UserID, "Token family should have been revoked")
+}
+
+func TestRmbMeCookieReplay(t *testing.T) {
+	a := testObject()
+	recorder := httptest.NewRecorder()
+	userID := randStr(64)
+	assert.Empty(t, a.generateRmbMeCookie(context.Background(), recorder, userID), "Error generating rmb me cookie")
+	stolen := &http.Request{Header: http.Header{"Cookie": recorder.HeaderMap["Set-Cookie"]}}
+
+	// Legitimate use rotates the cookie
+	recorder = httptest.NewRecorder()
+	userIDFound, err := a.checkRmbMeCookie(context.Background(), HTTPOpts{HTTPWriter: recorder, HTTPRequest: stolen})
+	assert.Empty(t, err, "Error checking rmb me cookie")
+	assert.Equal(t, userID, userIDFound, "Wrong user ID retrieved")
+	rotated := &http.Request{Header: http.Header{"Cookie": recorder.HeaderMap["Set-Cookie"]}}
+
+	// Replay of the original cookie is treated as theft
+	_, err = a.checkRmbMeCookie(context.Background(), HTTPOpts{HTTPWriter: httptest.NewRecorder(), HTTPRequest: stolen})
+	assert.Equal(t, ErrTokenReuse, err, "Replayed cookie should have been detected")
+
+	_, err = a.checkRmbMeCookie(context.Background(), HTTPOpts{HTTPWriter: httptest.NewRecorder(), HTTPRequest: rotated})
+	assert.NotEmpty(t, err, "Rotated cookie should have been revoked along with its family")
+}
+
+func TestRmbMeCookieConcurrentReplay(t *testing.T) {
+	a := testObject()
+	recorder := httptest.NewRecorder()
+	userID := randStr(64)
+	assert.Empty(t, a.generateRmbMeCookie(context.Background(), recorder, userID), "Error generating rmb me cookie")
+	stolen := &http.Request{Header: http.Header{"Cookie": recorder.HeaderMap["Set-Cookie"]}}
+
+	const replays = 8
+	errs := make([]error, replays)
+	var wg sync.WaitGroup
+	for i := 0; i < replays; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = a.checkRmbMeCookie(context.Background(), HTTPOpts{HTTPWriter: httptest.NewRecorder(), HTTPRequest: stolen})
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded, reused := 0, 0
+	for _, err := range errs {
+		switch err {
+		case nil:
+			succeeded++
+		case ErrTokenReuse:
+			reused++
+		}
+	}
+	assert.Equal(t, 1, succeeded, "Exactly one replay should be accepted")
+	assert.NotZero(t, reused, "Reuse should be detected")
+}
+
+func TestRmbMeServerSideExpiry(t *testing.T) {
+	clock := newTestClock()
+	config := testObject().config
+	config.Clock = clock
+	a := New(config)
+	key, token, err := a.generateRmbMe(context.Background(), Store{UserID: randStr(64)}, time.Minute)
+	assert.Empty(t, err, "Error generating rmb me token")
+
+	clock.advance(2 * time.Minute)
+	_, err = a.checkRmbMeInDB(context.Background(), cookieOpts{key: key, token: token})
+	assert.Equal(t, errRmbMeExpired, err, "Expired token should not have been accepted")
+	entry, _ := a.db.Fetch(context.Background(), key)
+	assert.Empty(t, entry.UserID, "Expired token should have been removed")
+}
+
+func TestRmbMeMaxLifetime(t *testing.T) {
+	config := testObject().config
+	config.RmbMeMaxLifetime = time.Minute
+	a := New(config)
+
+	key, _, err := a.generateRmbMe(context.Background(), Store{UserID: randStr(64)}, time.Hour)
+	assert.Empty(t, err, "Error generating rmb me token")
+	entry, _ := a.db.Fetch(context.Background(), key)
+	assert.False(t, entry.FamilyExpires.IsZero(), "Family expiry was not set")
+	assert.Equal(t, entry.FamilyExpires, entry.Expires, "Token expiry should be capped by the family")
+
+	// Rotation keeps the original family expiry
+	newKey, _, err := a.rotateRmbMe(context.Background(), key, entry, time.Hour)
+	assert.Empty(t, err, "Error rotating rmb me token")
+	rotated, _ := a.db.Fetch(context.Background(), newKey)
+	assert.Equal(t, entry.FamilyExpires, rotated.Expires, "Rotation should not extend the family's lifetime")
+}
+
+func TestRmbMeCookieFamilyExpiry(t *testing.T) {
+	clock := newTestClock()
+	config := testObject().config
+	config.Clock = clock
+	config.RmbMeMaxLifetime = config.RmbMeTimeout + config.RmbMeTimeout/2
+	a := New(config)
+	recorder := httptest.NewRecorder()
+	assert.Empty(t, a.generateRmbMeCookie(context.Background(), recorder, randStr(64)), "Error generating rmb me cookie")
+	cookie := responseCookie(recorder, "rmbme")
+	assert.Equal(t, int(config.RmbMeTimeout.Seconds()), cookie.MaxAge, "Cookie should last for RmbMeTimeout")
+
+	// Close to the end of the family, the rotated cookie expires along with it
+	clock.advance(config.RmbMeTimeout * 3 / 4)
+	request := &http.Request{Header: http.Header{"Cookie": recorder.Result().Header["Set-Cookie"]}}
+	recorder = httptest.NewRecorder()
+	_, err := a.checkRmbMeCookie(context.Background(), HTTPOpts{HTTPWriter: recorder, HTTPRequest: request})
+	assert.Empty(t, err, "Error checking rmb me cookie")
+	cookie = responseCookie(recorder, "rmbme")
+	assert.Equal(t, int((config.RmbMeTimeout * 3 / 4).Seconds()), cookie.MaxAge, "Cookie should not outlive its family")
+}
+
+// responseCookie returns the cookie set by a response, with its attributes.
+func responseCookie(recorder *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return &http.Cookie{}
+}
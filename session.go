@@ -0,0 +1,101 @@
+package authlib
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// RegenerateSession moves the user's session to a new key and token, rewriting the auth
+// cookie, while keeping them logged in. The old key stops working at once. Call it when
+// the user's privileges change, e.g. after a password change or role elevation, so that
+// a session key planted or leaked beforehand cannot be used to ride on the new privileges.
+// The session keeps its forced expiry.
+// Returns http.ErrNoCookie if no auth cookie was sent, and ErrSessionExpired
+// if the session has expired or was logged out.
+func (a *Object) RegenerateSession(opts HTTPOpts) error {
+	return a.RegenerateSessionContext(contextOf(opts), opts)
+}
+
+// RegenerateSessionContext is RegenerateSession, traced as a child of the span in ctx.
+func (a *Object) RegenerateSessionContext(ctx context.Context, opts HTTPOpts) (err error) {
+	ctx, span := a.startSpan(ctx, "authlib-regenerateSession", opts.SpanContext)
+	defer span.end()
+	defer func() { span.setError(err) }()
+
+	session, err := a.sessionOf(ctx, opts.HTTPRequest)
+	if err != nil {
+		return err
+	}
+	userID := session.UserID
+	span.setUserID(userID)
+
+	key, token := newSessionKey(userID)
+	hashedToken, err := a.hashToken(ctx, token)
+	if err != nil {
+		return err
+	}
+	// Everything but the token carries over to the new key, including changes
+	// made by concurrent requests up to the move
+	var maxExpiry time.Time
+	found, err := a.store.replace(ctx, session.key, key, func(value *storeValue) error {
+		value.HashedToken = hashedToken
+		maxExpiry = value.MaxExpiry
+		return nil
+	})
+	if err = storeError("regenerate session", err); err != nil {
+		return err
+	}
+	if !found {
+		// Expired or logged out in the meantime
+		return ErrSessionExpired
+	}
+
+	err = a.sc.Set(opts.HTTPWriter, "auth", cookieValue{
+		Key:   key,
+		Token: token,
+	}, maxExpiry.Sub(a.config.now()))
+	if err != nil {
+		return err
+	}
+
+	a.audit(ctx, opts.HTTPRequest, AuditEvent{
+		Type:      AuditSessionRegenerate,
+		UserID:    userID,
+		SessionID: sessionID(key),
+		Outcome:   AuditSuccess,
+	})
+	return nil
+}
+
+// ListSessions returns the sessions of a user that have not expired, oldest first,
+// e.g. to show them on an account page. The sessions are described as by CheckSession,
+// and their SessionIDs match those in audit events.
+func (a *Object) ListSessions(opts ListSessionsOpts) (sessions []SessionStatus, err error) {
+	return a.ListSessionsContext(context.Background(), opts)
+}
+
+// ListSessionsContext is ListSessions, traced as a child of the span in ctx.
+func (a *Object) ListSessionsContext(ctx context.Context, opts ListSessionsOpts) (sessions []SessionStatus, err error) {
+	ctx, span := a.startSpan(ctx, "authlib-listSessions", opts.SpanContext)
+	defer span.end()
+	defer func() { span.setError(err) }()
+	span.setUserID(opts.UserID)
+
+	values, err := a.store.userSessions(ctx, opts.UserID)
+	if err = storeError("list sessions", err); err != nil {
+		return nil, err
+	}
+	now := a.config.now()
+	for key, value := range values {
+		if now.After(value.Expires) || now.After(value.MaxExpiry) {
+			continue
+		}
+		sessions = append(sessions, a.sessionStatus(key, value))
+	}
+	// Every session lasts as long, so the one with the earliest forced expiry is the oldest
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].AbsoluteRemaining < sessions[j].AbsoluteRemaining
+	})
+	return sessions, nil
+}
@@ -0,0 +1,154 @@
+package authlib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// SessionCodec encodes session data for the store. Its methods match
+// json.Marshal and json.Unmarshal.
+type SessionCodec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// JSONCodec encodes session data as JSON. It is the default SessionCodec.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// sessionCodec returns the configured codec, or JSONCodec.
+func (c Config) sessionCodec() SessionCodec {
+	if c.SessionCodec == nil {
+		return JSONCodec{}
+	}
+	return c.SessionCodec
+}
+
+// Session gives access to the data of a logged in user's session, such as their
+// selected organisation or locale. It is put in the request context by RequireLogin.
+// Data is kept in the session store, and removed along with the session.
+type Session struct {
+	UserID    string
+	SessionID string // Identifies the session, as in audit events
+
+	a   *Object
+	key string
+}
+
+// Get decodes the value stored under name into value, which must be a pointer.
+// found is false if nothing is stored under name.
+// Returns ErrSessionExpired if the session no longer exists, e.g. as it was logged out.
+func (s *Session) Get(ctx context.Context, name string, value any) (found bool, err error) {
+	stored, ok, err := s.a.store.get(ctx, s.key)
+	if err = storeError("get session", err); err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, ErrSessionExpired
+	}
+	data, found := stored.Data[name]
+	if !found {
+		return false, nil
+	}
+	return true, s.a.config.sessionCodec().Unmarshal(data, value)
+}
+
+// Set stores value under name, replacing any previous value. If the session's data
+// would grow past the size limit, ErrSessionDataTooLarge is returned and nothing is stored.
+func (s *Session) Set(ctx context.Context, name string, value any) error {
+	data, err := s.a.config.sessionCodec().Marshal(value)
+	if err != nil {
+		return err
+	}
+	return s.update(ctx, func(stored map[string][]byte) {
+		stored[name] = data
+	})
+}
+
+// Delete removes the value stored under name, if any.
+func (s *Session) Delete(ctx context.Context, name string) error {
+	return s.update(ctx, func(stored map[string][]byte) {
+		delete(stored, name)
+	})
+}
+
+// update applies fn to the session's data, rejecting the change if the data
+// grows past the size limit.
+func (s *Session) update(ctx context.Context, fn func(stored map[string][]byte)) error {
+	limit := s.a.maxDataSize()
+	found, err := s.a.store.update(ctx, s.key, func(value *storeValue) error {
+		if value.Data == nil {
+			value.Data = make(map[string][]byte)
+		}
+		before := dataSize(value.Data)
+		fn(value.Data)
+		// Data stored before the limit was lowered can still shrink
+		if size := dataSize(value.Data); size > limit && size > before {
+			return fmt.Errorf("%w: %d bytes, over the limit of %d", ErrSessionDataTooLarge, size, limit)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrSessionDataTooLarge) {
+		return err
+	}
+	if err = storeError("save session data", err); err != nil {
+		return err
+	}
+	if !found {
+		return ErrSessionExpired
+	}
+	return nil
+}
+
+// maxDataSize returns the most bytes of data that may be stored for a session:
+// the store's limit, or the configured one if lower.
+func (a *Object) maxDataSize() int {
+	limit := a.store.maxDataSize()
+	if a.config.MaxSessionDataSize > 0 && a.config.MaxSessionDataSize < limit {
+		limit = a.config.MaxSessionDataSize
+	}
+	return limit
+}
+
+// dataSize counts the bytes of session data, names included.
+func dataSize(data map[string][]byte) (size int) {
+	for name, value := range data {
+		size += len(name) + len(value)
+	}
+	return
+}
+
+// SessionValue returns the value stored under name in the session of the request
+// context, decoded as a T. Returns ErrNoSession if the context has no session.
+func SessionValue[T any](ctx context.Context, name string) (value T, found bool, err error) {
+	session := SessionFromContext(ctx)
+	if session == nil {
+		return value, false, ErrNoSession
+	}
+	found, err = session.Get(ctx, name, &value)
+	return
+}
+
+// SetSessionValue stores value under name in the session of the request context.
+// Returns ErrNoSession if the context has no session.
+func SetSessionValue[T any](ctx context.Context, name string, value T) error {
+	session := SessionFromContext(ctx)
+	if session == nil {
+		return ErrNoSession
+	}
+	return session.Set(ctx, name, value)
+}
+
+// DeleteSessionValue removes the value stored under name in the session of the request context.
+// Returns ErrNoSession if the context has no session.
+func DeleteSessionValue(ctx context.Context, name string) error {
+	session := SessionFromContext(ctx)
+	if session == nil {
+		return ErrNoSession
+	}
+	return session.Delete(ctx, name)
+}
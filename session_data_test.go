@@ -0,0 +1,91 @@
+package authlib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testSession logs a user in, returning their session as RequireLogin would.
+func testSession(t *testing.T, a *Object) *Session {
+	key, err := a.saveLogin(context.Background(), saveLoginOpts{w: httptest.NewRecorder(), userID: randStr(64)})
+	assert.Empty(t, err, "Error saving login")
+	value, _, _ := a.store.get(context.Background(), key)
+	return &Session{UserID: value.UserID, SessionID: sessionID(key), a: a, key: key}
+}
+
+func TestSessionData(t *testing.T) {
+	type org struct {
+		ID   int
+		Name string
+	}
+	a := testObject()
+	ctx := context.Background()
+	session := testSession(t, a)
+
+	var got org
+	found, err := session.Get(ctx, "org", &got)
+	assert.False(t, found, "Nothing should be stored yet")
+	assert.Empty(t, err, "Error getting missing value")
+
+	assert.Empty(t, session.Set(ctx, "org", org{ID: 1, Name: "Acme"}), "Error setting value")
+	found, err = session.Get(ctx, "org", &got)
+	assert.True(t, found, "Value should be found")
+	assert.Empty(t, err, "Error getting value")
+	assert.Equal(t, org{ID: 1, Name: "Acme"}, got, "Wrong value stored")
+
+	// The typed helpers reach the session through the context
+	ctx = context.WithValue(ctx, sessionContextKey{}, session)
+	assert.Empty(t, SetSessionValue(ctx, "locale", "en-GB"), "Error setting typed value")
+	locale, found, err := SessionValue[string](ctx, "locale")
+	assert.True(t, found, "Typed value should be found")
+	assert.Empty(t, err, "Error getting typed value")
+	assert.Equal(t, "en-GB", locale, "Wrong typed value stored")
+
+	assert.Empty(t, DeleteSessionValue(ctx, "locale"), "Error deleting value")
+	_, found, _ = SessionValue[string](ctx, "locale")
+	assert.False(t, found, "Deleted value should not be found")
+
+	_, _, err = SessionValue[string](context.Background(), "locale")
+	assert.ErrorIs(t, err, ErrNoSession, "Context without a session should be reported")
+
+	// Data goes with the session
+	a.store.unset(ctx, session.key)
+	assert.ErrorIs(t, session.Set(ctx, "org", org{}), ErrSessionExpired, "Logged out session should be reported")
+}
+
+func TestSessionDataLimit(t *testing.T) {
+	config := testObject().config
+	config.MaxSessionDataSize = 100
+	a := New(config)
+	ctx := context.Background()
+	session := testSession(t, a)
+
+	assert.Empty(t, session.Set(ctx, "small", strings.Repeat("a", 50)), "Data within the limit should be stored")
+	err := session.Set(ctx, "large", strings.Repeat("a", 50))
+	assert.ErrorIs(t, err, ErrSessionDataTooLarge, "Data over the limit should be rejected")
+	found, _ := session.Get(ctx, "large", new(string))
+	assert.False(t, found, "Rejected data should not be stored")
+
+	// The configured limit cannot be raised past the store's
+	a.config.MaxSessionDataSize = mapStoreMaxDataSize * 2
+	assert.Equal(t, mapStoreMaxDataSize, a.maxDataSize(), "Store limit should apply")
+}
+
+func TestSessionDataKeptOnCheck(t *testing.T) {
+	a := testObject()
+	recorder := httptest.NewRecorder()
+	key, _ := a.saveLogin(context.Background(), saveLoginOpts{w: recorder, userID: randStr(64)})
+	session := &Session{a: a, key: key}
+	assert.Empty(t, session.Set(context.Background(), "flash", "Saved"), "Error setting value")
+
+	request := &http.Request{Header: http.Header{"Cookie": recorder.Result().Header["Set-Cookie"]}}
+	_, valid, _ := a.CheckLogin(HTTPOpts{HTTPWriter: httptest.NewRecorder(), HTTPRequest: request})
+	assert.True(t, valid, "Session should be valid")
+	found, _ := session.Get(context.Background(), "flash", new(string))
+	assert.True(t, found, "Data should be kept when the session is refreshed")
+}
@@ -0,0 +1,121 @@
+package authlib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegenerateSession(t *testing.T) {
+	a := testObject()
+	ctx := context.Background()
+	userID := randStr(64)
+	recorder := httptest.NewRecorder()
+	oldKey, err := a.saveLogin(ctx, saveLoginOpts{w: recorder, userID: userID})
+	assert.Empty(t, err, "Error saving login")
+	oldValue, _, _ := a.store.get(ctx, oldKey)
+	oldRequest := &http.Request{Header: http.Header{"Cookie": recorder.Result().Header["Set-Cookie"]}}
+
+	regenerated := httptest.NewRecorder()
+	err = a.RegenerateSession(HTTPOpts{HTTPWriter: regenerated, HTTPRequest: oldRequest})
+	assert.Empty(t, err, "Error regenerating session")
+
+	// The old cookie no longer works
+	_, found, _ := a.store.get(ctx, oldKey)
+	assert.False(t, found, "Old session key should be removed")
+	_, valid, err := a.CheckLogin(HTTPOpts{HTTPWriter: httptest.NewRecorder(), HTTPRequest: oldRequest})
+	assert.False(t, valid, "Old cookie should not be accepted")
+	assert.ErrorIs(t, err, ErrSessionExpired, "Old cookie should be reported as expired")
+
+	// The new one does, keeping the session's forced expiry
+	newRequest := &http.Request{Header: http.Header{"Cookie": regenerated.Result().Header["Set-Cookie"]}}
+	checkedID, valid, _ := a.CheckLogin(HTTPOpts{HTTPWriter: httptest.NewRecorder(), HTTPRequest: newRequest})
+	assert.True(t, valid, "New cookie should be accepted")
+	assert.Equal(t, userID, checkedID, "Session should belong to the same user")
+	newCookie, err := a.sc.Get(newRequest, "auth")
+	assert.Empty(t, err, "New auth cookie could not be read")
+	assert.NotEqual(t, oldKey, newCookie.Key, "Session should have a new key")
+	newValue, _, _ := a.store.get(ctx, newCookie.Key)
+	assert.Equal(t, oldValue.MaxExpiry, newValue.MaxExpiry, "Forced expiry should carry over")
+
+	// Without a session, there is nothing to regenerate
+	err = a.RegenerateSession(HTTPOpts{HTTPWriter: httptest.NewRecorder(), HTTPRequest: &http.Request{}})
+	assert.ErrorIs(t, err, http.ErrNoCookie, "Missing cookie should be reported")
+	err = a.RegenerateSession(HTTPOpts{HTTPWriter: httptest.NewRecorder(), HTTPRequest: oldRequest})
+	assert.ErrorIs(t, err, ErrSessionExpired, "Regenerated session should not be regenerated again")
+}
+
+func TestRegenerateSessionKeepsConcurrentChanges(t *testing.T) {
+	a := testObject()
+	ctx := context.Background()
+	for i := 0; i < 50; i++ {
+		recorder := httptest.NewRecorder()
+		_, err := a.saveLogin(ctx, saveLoginOpts{w: recorder, userID: randStr(64)})
+		assert.Empty(t, err, "Error saving login")
+		oldRequest := &http.Request{Header: http.Header{"Cookie": recorder.Result().Header["Set-Cookie"]}}
+		session, err := a.sessionOf(ctx, oldRequest)
+		assert.Empty(t, err, "Error reading session")
+
+		// Data set while the session is regenerated either carries over, or is rejected
+		var wg sync.WaitGroup
+		var setErr error
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			setErr = session.Set(ctx, "org", i)
+		}()
+		regenerated := httptest.NewRecorder()
+		assert.Empty(t, a.RegenerateSession(HTTPOpts{HTTPWriter: regenerated, HTTPRequest: oldRequest}), "Error regenerating session")
+		wg.Wait()
+
+		newRequest := &http.Request{Header: http.Header{"Cookie": regenerated.Result().Header["Set-Cookie"]}}
+		newSession, err := a.sessionOf(ctx, newRequest)
+		assert.Empty(t, err, "Error reading regenerated session")
+		var org int
+		found, _ := newSession.Get(ctx, "org", &org)
+		if setErr == nil {
+			assert.True(t, found, "Data set before the session moved should carry over")
+			assert.Equal(t, i, org, "Data set before the session moved should carry over")
+		} else {
+			assert.ErrorIs(t, setErr, ErrSessionExpired, "Data set after the session moved should be rejected")
+			assert.False(t, found, "Rejected data should not be stored")
+		}
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	clock := newTestClock()
+	config := testObject().config
+	config.Clock = clock
+	a := New(config)
+	ctx := context.Background()
+	userID := randStr(64)
+
+	first, _, err := a.saveLoginInStore(ctx, userID, AuthPassword)
+	assert.Empty(t, err, "Error saving first session")
+	clock.advance(time.Second)
+	second, _, err := a.saveLoginInStore(ctx, userID, AuthExternal)
+	assert.Empty(t, err, "Error saving second session")
+	_, _, err = a.saveLoginInStore(ctx, randStr(64), AuthPassword)
+	assert.Empty(t, err, "Error saving other user's session")
+
+	sessions, err := a.ListSessionsContext(ctx, ListSessionsOpts{UserID: userID})
+	assert.Empty(t, err, "Error listing sessions")
+	if assert.Len(t, sessions, 2, "Only the user's sessions should be listed") {
+		assert.Equal(t, sessionID(first), sessions[0].SessionID, "Oldest session should be listed first")
+		assert.Equal(t, AuthPassword, sessions[0].Origin, "Origin should be listed")
+		assert.Equal(t, sessionID(second), sessions[1].SessionID, "Newest session should be listed last")
+		assert.Equal(t, userID, sessions[1].UserID, "Sessions should belong to the user")
+	}
+
+	// Expired sessions are left out
+	clock.advance(config.IdleTimeout + time.Second)
+	sessions, err = a.ListSessions(ListSessionsOpts{UserID: userID})
+	assert.Empty(t, err, "Error listing sessions")
+	assert.Empty(t, sessions, "Expired sessions should not be listed")
+}
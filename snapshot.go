@@ -0,0 +1,207 @@
+package authlib
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotHeader starts every snapshot file, and is authenticated along with its contents.
+var snapshotHeader = []byte("authlib-snapshot-v1\n")
+
+// snapshotKeyInfo separates the snapshot key from any other key derived from the KMS.
+var snapshotKeyInfo = []byte("authlib session snapshot")
+
+// snapshotter saves the sessions of a map store to an encrypted file.
+type snapshotter struct {
+	path string
+	keys [][]byte // Encryption keys derived from the KMS, the current one first
+	log  Logger
+	stop chan struct{}
+	done chan struct{} // Closed once the final snapshot has been written
+}
+
+// snapshotKeys derives the keys that snapshots are encrypted with from the cookie
+// keys, the current one first. Keys replaced by RotateKMSFile are kept to read
+// snapshots written before the rotation.
+func (kms *keyManagementStore) snapshotKeys() (keys [][]byte) {
+	hashKeys := [][]byte{kms.CookiesHash}
+	for _, previous := range kms.Previous {
+		hashKeys = append(hashKeys, previous.CookiesHash)
+	}
+	for _, hashKey := range hashKeys {
+		keys = append(keys, deriveKey(hashKey, snapshotKeyInfo))
+	}
+	return
+}
+
+// writeSnapshot encrypts the sessions with AES-GCM under key, and writes them to path.
+// The file is replaced in one step, so that a crash leaves the previous snapshot intact.
+func writeSnapshot(path string, key []byte, sessions map[string]storeValue) error {
+	var plaintext bytes.Buffer
+	if err := gob.NewEncoder(&plaintext).Encode(sessions); err != nil {
+		return err
+	}
+	aead, err := snapshotCipher(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	contents := append(append([]byte{}, snapshotHeader...), nonce...)
+	contents = aead.Seal(contents, nonce, plaintext.Bytes(), snapshotHeader)
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err = file.Write(contents); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// readSnapshot reads the sessions written by writeSnapshot, trying each key in turn.
+func readSnapshot(path string, keys [][]byte) (sessions map[string]storeValue, err error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(contents, snapshotHeader) {
+		return nil, errors.New("not a session snapshot")
+	}
+	contents = contents[len(snapshotHeader):]
+
+	for _, key := range keys {
+		aead, err := snapshotCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(contents) < aead.NonceSize() {
+			return nil, errors.New("session snapshot is truncated")
+		}
+		nonce, ciphertext := contents[:aead.NonceSize()], contents[aead.NonceSize():]
+		plaintext, err := aead.Open(nil, nonce, ciphertext, snapshotHeader)
+		if err != nil {
+			continue
+		}
+		if err = gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&sessions); err != nil {
+			return nil, fmt.Errorf("could not decode session snapshot: %w", err)
+		}
+		return sessions, nil
+	}
+	return nil, errors.New("session snapshot could not be decrypted with the keys in the KMS file")
+}
+
+func snapshotCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// snapshot returns a copy of every session held. Shards are copied one at a time.
+func (store *mapStore) snapshot() map[string]storeValue {
+	sessions := make(map[string]storeValue)
+	for _, shard := range store.shards {
+		shard.mux.RLock()
+		for key, value := range shard.storage {
+			sessions[key] = value.clone()
+		}
+		shard.mux.RUnlock()
+	}
+	return sessions
+}
+
+// restore stores the sessions that have not expired at the given time,
+// returning the number of sessions restored.
+func (store *mapStore) restore(sessions map[string]storeValue, now time.Time) (restored int) {
+	for key, value := range sessions {
+		if now.After(value.Expires) || now.After(value.MaxExpiry) {
+			continue
+		}
+		shard := store.shard(key)
+		shard.mux.Lock()
+		shard.put(key, value)
+		shard.mux.Unlock()
+		store.trim()
+		restored++
+	}
+	return
+}
+
+// startSnapshots restores the sessions saved at path, then saves them there at the
+// given interval and once more when the store is closed. An interval of 0 only saves
+// them on close. Calls made while snapshots are being saved have no effect.
+func (store *mapStore) startSnapshots(path string, interval time.Duration, kms *keyManagementStore, clock Clock, log Logger) {
+	s := &snapshotter{
+		path: path,
+		keys: kms.snapshotKeys(),
+		log:  log,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	store.mux.Lock()
+	if store.snapshots != nil {
+		store.mux.Unlock()
+		return
+	}
+	store.snapshots = s
+	store.mux.Unlock()
+
+	// close waits for done, so the final snapshot is only written once the restore is over
+	sessions, err := readSnapshot(path, s.keys)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		log.Info("No session snapshot found, starting empty", logPath, path)
+	case err != nil:
+		// Sessions are lost, as they would be without snapshots
+		log.Error("Could not restore session snapshot, it will be overwritten", logPath, path, logError, err)
+	default:
+		log.Info("Restored session snapshot", logPath, path, logRestored, store.restore(sessions, clock.Now()))
+	}
+
+	go func() {
+		defer close(s.done)
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-s.stop:
+				store.saveSnapshot(s)
+				return
+			case <-tick:
+				store.saveSnapshot(s)
+			}
+		}
+	}()
+}
+
+// saveSnapshot writes the sessions held to the snapshotter's file, encrypted with the current key.
+func (store *mapStore) saveSnapshot(s *snapshotter) {
+	sessions := store.snapshot()
+	if err := writeSnapshot(s.path, s.keys[0], sessions); err != nil {
+		s.log.Error("Could not save session snapshot", logPath, s.path, logError, err)
+		return
+	}
+	s.log.Debug("Saved session snapshot", logPath, s.path, logSaved, len(sessions))
+}
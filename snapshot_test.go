@@ -0,0 +1,107 @@
+package authlib
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.snapshot")
+	kms := generateKMS()
+	now := time.Now()
+	userID := randStr(64)
+	sessions := map[string]storeValue{
+		"live": {
+			UserID:    userID,
+			Expires:   now.Add(time.Hour),
+			MaxExpiry: now.Add(time.Hour * 24),
+			Origin:    AuthPassword,
+			Data:      map[string][]byte{"org": []byte("42")},
+		},
+		"expired": {UserID: userID, Expires: now.Add(-time.Second), MaxExpiry: now.Add(time.Hour)},
+	}
+
+	assert.Empty(t, writeSnapshot(path, kms.snapshotKeys()[0], sessions), "Error writing snapshot")
+	contents, _ := os.ReadFile(path)
+	assert.False(t, bytes.Contains(contents, []byte(userID)), "Snapshot should be encrypted")
+
+	read, err := readSnapshot(path, kms.snapshotKeys())
+	assert.Empty(t, err, "Error reading snapshot")
+	store := createMapStore()
+	assert.Equal(t, 1, store.restore(read, now), "Only the live session should be restored")
+	value, found, _ := store.get(context.Background(), "live")
+	assert.True(t, found, "Live session should be restored")
+	assert.Equal(t, []byte("42"), value.Data["org"], "Session data should be restored")
+	assert.Equal(t, AuthPassword, value.Origin, "Session details should be restored")
+	_, found, _ = store.get(context.Background(), "expired")
+	assert.False(t, found, "Expired session should not be restored")
+
+	// Other keys cannot read it
+	other := generateKMS()
+	_, err = readSnapshot(path, other.snapshotKeys())
+	assert.Error(t, err, "Snapshot should not be readable with other keys")
+
+	// Keys kept by a rotation can
+	other.Previous = []previousKeys{{CookiesHash: kms.CookiesHash, CookiesBlock: kms.CookiesBlock}}
+	read, err = readSnapshot(path, other.snapshotKeys())
+	assert.Empty(t, err, "Snapshot should be readable with the previous keys")
+	assert.Len(t, read, 2, "Every session should be read")
+
+	// Tampering is detected
+	contents[len(contents)-1] ^= 1
+	os.WriteFile(path, contents, 0600)
+	_, err = readSnapshot(path, kms.snapshotKeys())
+	assert.Error(t, err, "Tampered snapshot should be rejected")
+}
+
+func TestMapStoreSnapshots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.snapshot")
+	kms := generateKMS()
+	clock := newTestClock()
+	ctx := context.Background()
+	expiry := clock.Now().Add(time.Hour)
+
+	// Without a snapshot, the store starts empty and saves on close
+	store := createMapStore()
+	store.startSnapshots(path, 0, &kms, clock, nopLogger{})
+	store.set(ctx, "key", storeValue{UserID: "user", Expires: expiry, MaxExpiry: expiry})
+	store.close()
+	store.close()
+	_, err := os.Stat(path)
+	assert.Empty(t, err, "Snapshot should be saved on close")
+
+	restarted := createMapStore()
+	restarted.startSnapshots(path, time.Millisecond, &kms, clock, nopLogger{})
+	_, found, _ := restarted.get(ctx, "key")
+	assert.True(t, found, "Session should be restored from the snapshot")
+
+	// Snapshots are saved periodically
+	restarted.set(ctx, "periodic", storeValue{UserID: "user", Expires: expiry, MaxExpiry: expiry})
+	assert.Eventually(t, func() bool {
+		sessions, err := readSnapshot(path, kms.snapshotKeys())
+		_, found := sessions["periodic"]
+		return err == nil && found
+	}, time.Second, time.Millisecond, "Snapshot should be saved at the interval")
+	restarted.close()
+
+	// Snapshots can be started again once the store is closed
+	restarted.startSnapshots(path, 0, &kms, clock, nopLogger{})
+	restarted.set(ctx, "reopened", storeValue{UserID: "user", Expires: expiry, MaxExpiry: expiry})
+	restarted.close()
+	sessions, err := readSnapshot(path, kms.snapshotKeys())
+	assert.Empty(t, err, "Error reading snapshot")
+	assert.Contains(t, sessions, "reopened", "Snapshot should be saved on close after a restart")
+
+	// Sessions that expired while the app was down are dropped
+	clock.advance(time.Hour * 2)
+	expired := createMapStore()
+	expired.startSnapshots(path, 0, &kms, clock, nopLogger{})
+	defer expired.close()
+	assert.Zero(t, expired.stats().Sessions, "Expired sessions should not be restored")
+}
@@ -1,12 +1,60 @@
 package authlib
 
-import "sync"
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+)
 
+// storeInterface is implemented by session stores. Operations give up
+// and return the context's error once it is cancelled or past its deadline.
+// replace atomically moves a session to a new key, applying fn to it on the way,
+// and doing nothing if the old key is no longer held or fn returns an error.
+// update atomically applies fn to a session, saving it unless fn returns an error. setLimited is set,
+// first making room if the session's user already holds limit.max live sessions,
+// returning the keys of the sessions evicted, or ErrTooManySessions.
+// Stores keep an index of the sessions of each user, so that unsetAll,
+// userSessions and setLimited only touch the sessions of that user. maxDataSize is the
+// most session data, in bytes, that the store will hold for a session.
 type storeInterface interface {
-	set(string, storeValue)
-	get(string) (storeValue, bool)
-	unset(string)
-	unsetAll(string)
+	set(context.Context, string, storeValue) error
+	setLimited(ctx context.Context, key string, value storeValue, limit sessionLimit) (evicted []string, err error)
+	get(context.Context, string) (storeValue, bool, error)
+	unset(context.Context, string) error
+	unsetAll(context.Context, string) error
+	userSessions(ctx context.Context, userID string) (map[string]storeValue, error)
+	replace(ctx context.Context, oldKey, newKey string, fn func(*storeValue) error) (found bool, err error)
+	update(ctx context.Context, key string, fn func(*storeValue) error) (found bool, err error)
+	maxDataSize() int
+	stats() StoreStats
+	close()
+}
+
+// sessionLimit bounds the number of live sessions of a user.
+type sessionLimit struct {
+	max         int
+	evictOldest bool      // Whether to evict the oldest sessions to make room, rather than refusing
+	now         time.Time // Sessions expired by now do not count
+}
+
+// clone returns a copy of the value that can be changed without affecting the original.
+func (v storeValue) clone() storeValue {
+	if v.Data != nil {
+		data := make(map[string][]byte, len(v.Data))
+		for name, value := range v.Data {
+			data[name] = value
+		}
+		v.Data = data
+	}
+	return v
+}
+
+// StoreStats reports on the state of the session store.
+type StoreStats struct {
+	Sessions          int    // Number of sessions currently held, including expired ones not yet evicted. Not counted for Redis.
+	Evictions         uint64 // Number of expired sessions evicted by the sweeper
+	CapacityEvictions uint64 // Number of sessions evicted before they expired, as the store held MaxStoredSessions
 }
 
 type storeType struct {
@@ -16,23 +64,31 @@ type storeType struct {
 var storeSingleton storeInterface
 var storeOnce sync.Once
 
-func getStore(redisConn, redisNamespace string) storeInterface {
+func getStore(redisConn, redisNamespace string, log Logger) storeInterface {
 	storeOnce.Do(func() {
-		// var err error
-		// if redisConn != "" {
-		// 	// Attempt to connect to Redis
-		// 	getLogger().Info("Attempting to connect to Redis on " + redisConn)
-		// 	storeSingleton, err = createRedisStore(redisConn, redisNamespace)
-		// 	if err == nil {
-		// 		getLogger().Info("Successfully connected")
-		// 	} else {
-		// 		getLogger().Warn("Could not connect to Redis")
-		// 	}
-		// }
-		// if redisConn == "" || err != nil {
-		storeSingleton = createMapStore()
-		getLogger().Info("Using in-built map store")
-		// }
+		var err error
+		if redisConn != "" {
+			// Attempt to connect to Redis
+			log.Info("Connecting to Redis", "conn", redactConn(redisConn))
+			storeSingleton, err = createRedisStore(redisConn, redisNamespace)
+			if err == nil {
+				log.Info("Connected to Redis", "conn", redactConn(redisConn))
+			} else {
+				log.Warn("Could not connect to Redis, falling back to the in-built map store", "conn", redactConn(redisConn), logError, err)
+			}
+		}
+		if redisConn == "" || err != nil {
+			storeSingleton = createMapStore()
+			log.Info("Using in-built map store")
+		}
 	})
 	return storeSingleton
 }
+
+// redactConn hides the password in a Redis URL, so that it can be logged.
+func redactConn(conn string) string {
+	if u, err := url.Parse(conn); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return conn
+}
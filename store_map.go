@@ -1,40 +1,475 @@
 package authlib
 
-import "sync"
+import (
+	"container/list"
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
+// mapStoreMaxDataSize bounds the session data held in memory for each session.
+const mapStoreMaxDataSize = 64 << 10
+
+// mapStoreShards is the number of shards of the map store. It must be a power of two.
+const mapStoreShards = 32
+
+// mapStore keeps sessions in memory, split into shards by key so that requests
+// for different sessions rarely wait on each other.
 type mapStore struct {
+	evictions         uint64 // Accessed atomically, so kept first for alignment on 32-bit platforms
+	capacityEvictions uint64 // Accessed atomically
+	shards            []*mapShard
+	lru               *mapLRU
+	limitMux          sync.Mutex // Serialises setLimited, as the sessions of a user span shards
+
+	mux       sync.Mutex // Guards onEvict, stop and snapshots
+	onEvict   func(key string, value storeValue)
+	stop      chan struct{} // Stops the janitor, nil while it is not running
+	snapshots *snapshotter  // Nil while snapshots are not being saved
+}
+
+// mapShard holds the sessions whose keys hash to it, along with an index
+// of those sessions by user.
+type mapShard struct {
+	mux     sync.RWMutex
 	storage map[string]storeValue
-	mux     *sync.Mutex
+	users   map[string]map[string]struct{} // User ID to the keys of their sessions
+	lru     *mapLRU                        // Shared by every shard of the store
+}
+
+// mapLRU orders the sessions of every shard by when they were last stored, so that
+// the least recently used one can be evicted from whichever shard holds it. Its lock
+// is taken while holding a shard's lock, and never the other way round.
+type mapLRU struct {
+	mux      sync.Mutex
+	recency  *list.List               // Keys, the most recently stored first
+	elements map[string]*list.Element // Key to its element in recency
+	capacity int                      // Most sessions held, 0 meaning no limit
 }
 
-func createMapStore() mapStore {
-	return mapStore{
-		storage: make(map[string]storeValue),
-		mux:     &sync.Mutex{},
+// evictedSession is a session removed to keep the store within its capacity.
+type evictedSession struct {
+	key   string
+	value storeValue
+}
+
+func createMapStore() *mapStore {
+	return newMapStore(mapStoreShards)
+}
+
+// newMapStore creates a map store with the given number of shards, a power of two.
+func newMapStore(shards int) *mapStore {
+	store := &mapStore{
+		shards: make([]*mapShard, shards),
+		lru: &mapLRU{
+			recency:  list.New(),
+			elements: make(map[string]*list.Element),
+		},
 	}
+	for i := range store.shards {
+		store.shards[i] = &mapShard{
+			storage: make(map[string]storeValue),
+			users:   make(map[string]map[string]struct{}),
+			lru:     store.lru,
+		}
+	}
+	return store
 }
 
-func (store mapStore) set(key string, value storeValue) {
+// shardIndex returns the index of the shard holding key, hashed with FNV-1a.
+func (store *mapStore) shardIndex(key string) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash & uint32(len(store.shards)-1))
+}
+
+func (store *mapStore) shard(key string) *mapShard {
+	return store.shards[store.shardIndex(key)]
+}
+
+// setCapacity bounds the number of sessions held, evicting the least recently
+// stored sessions beyond it and passing each to onEvict. Sessions are stored again
+// whenever CheckLogin refreshes them, so this is the order they were last used in.
+// The bound applies to the store as a whole, whichever shards the sessions are in.
+// A max of 0 removes the bound.
+func (store *mapStore) setCapacity(max int, onEvict func(key string, value storeValue)) {
 	store.mux.Lock()
-	defer store.mux.Unlock()
-	store.storage[key] = value
+	store.onEvict = onEvict
+	store.mux.Unlock()
+
+	store.lru.mux.Lock()
+	store.lru.capacity = max
+	store.lru.mux.Unlock()
+	store.trim()
+}
+
+// touch marks a session as the most recently stored.
+func (lru *mapLRU) touch(key string) {
+	lru.mux.Lock()
+	defer lru.mux.Unlock()
+	if element, found := lru.elements[key]; found {
+		lru.recency.MoveToFront(element)
+	} else {
+		lru.elements[key] = lru.recency.PushFront(key)
+	}
+}
+
+// remove forgets a session that is no longer held.
+func (lru *mapLRU) remove(key string) {
+	lru.mux.Lock()
+	defer lru.mux.Unlock()
+	if element, found := lru.elements[key]; found {
+		lru.recency.Remove(element)
+		delete(lru.elements, key)
+	}
+}
+
+// oldest returns the least recently stored session, if more sessions than the capacity are held.
+func (lru *mapLRU) oldest() (key string, over bool) {
+	lru.mux.Lock()
+	defer lru.mux.Unlock()
+	if lru.capacity == 0 || lru.recency.Len() <= lru.capacity {
+		return "", false
+	}
+	return lru.recency.Back().Value.(string), true
+}
+
+// evict forgets key if it is still the least recently stored session and more sessions
+// than the capacity are held, reporting whether it did. The lock of the shard holding
+// key must be held, so that the session cannot be stored again in the meantime.
+func (lru *mapLRU) evict(key string) bool {
+	lru.mux.Lock()
+	defer lru.mux.Unlock()
+	if lru.capacity == 0 || lru.recency.Len() <= lru.capacity || lru.recency.Back().Value.(string) != key {
+		return false
+	}
+	lru.recency.Remove(lru.elements[key])
+	delete(lru.elements, key)
+	return true
+}
+
+// trim evicts the least recently stored sessions while more than the capacity are held,
+// then reports them. It must be called without holding a shard's lock, as the sessions
+// evicted may be in any shard, and onEvict may use the store.
+func (store *mapStore) trim() {
+	var evicted []evictedSession
+	for {
+		key, over := store.lru.oldest()
+		if !over {
+			break
+		}
+		shard := store.shard(key)
+		shard.mux.Lock()
+		// The session may have been used or removed since it was picked, so check again
+		if store.lru.evict(key) {
+			evicted = append(evicted, evictedSession{key: key, value: shard.storage[key]})
+			shard.drop(key)
+		}
+		shard.mux.Unlock()
+	}
+	store.evict(evicted)
+}
+
+// evict reports sessions evicted by trim.
+func (store *mapStore) evict(evicted []evictedSession) {
+	if len(evicted) == 0 {
+		return
+	}
+	atomic.AddUint64(&store.capacityEvictions, uint64(len(evicted)))
+	store.mux.Lock()
+	onEvict := store.onEvict
+	store.mux.Unlock()
+	if onEvict != nil {
+		for _, session := range evicted {
+			onEvict(session.key, session.value)
+		}
+	}
+}
+
+func (store *mapStore) set(ctx context.Context, key string, value storeValue) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer store.trim()
+	shard := store.shard(key)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+	shard.put(key, value)
+	return nil
+}
+
+func (store *mapStore) setLimited(ctx context.Context, key string, value storeValue, limit sessionLimit) (evicted []string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	store.limitMux.Lock()
+	defer store.limitMux.Unlock()
+
+	// Expired sessions no longer count, and are evicted along the way
+	live := make(map[string]storeValue)
+	for _, shard := range store.shards {
+		shard.mux.Lock()
+		for userKey := range shard.users[value.UserID] {
+			if existing := shard.storage[userKey]; limit.now.After(existing.Expires) || limit.now.After(existing.MaxExpiry) {
+				shard.remove(userKey)
+				atomic.AddUint64(&store.evictions, 1)
+				continue
+			}
+			live[userKey] = shard.storage[userKey]
+		}
+		shard.mux.Unlock()
+	}
+	if len(live) >= limit.max {
+		if !limit.evictOldest {
+			return nil, ErrTooManySessions
+		}
+		// The sessions established first are the first to reach their forced expiry
+		keys := make([]string, 0, len(live))
+		for userKey := range live {
+			keys = append(keys, userKey)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return live[keys[i]].MaxExpiry.Before(live[keys[j]].MaxExpiry)
+		})
+		evicted = keys[:len(keys)-limit.max+1]
+		for _, userKey := range evicted {
+			shard := store.shard(userKey)
+			shard.mux.Lock()
+			shard.remove(userKey)
+			shard.mux.Unlock()
+		}
+	}
+
+	defer store.trim()
+	shard := store.shard(key)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+	shard.put(key, value)
+	return evicted, nil
+}
+
+// put stores a session, adding it to the index of its user and marking it as the most
+// recently stored. The store may then hold more sessions than its capacity, so trim
+// must be called once the lock is released. The lock must be held.
+func (shard *mapShard) put(key string, value storeValue) {
+	if existing, found := shard.storage[key]; found && existing.UserID != value.UserID {
+		shard.drop(key)
+	}
+	shard.storage[key] = value
+	keys, found := shard.users[value.UserID]
+	if !found {
+		keys = make(map[string]struct{})
+		shard.users[value.UserID] = keys
+	}
+	keys[key] = struct{}{}
+	shard.lru.touch(key)
+}
+
+// remove deletes a session, removing it from the index of its user. The lock must be held.
+func (shard *mapShard) remove(key string) {
+	shard.drop(key)
+	shard.lru.remove(key)
+}
+
+// drop is remove, leaving the session in the recency order. The lock must be held.
+func (shard *mapShard) drop(key string) {
+	value, found := shard.storage[key]
+	if !found {
+		return
+	}
+	delete(shard.storage, key)
+	if keys := shard.users[value.UserID]; keys != nil {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(shard.users, value.UserID)
+		}
+	}
+}
+
+func (store *mapStore) get(ctx context.Context, key string) (value storeValue, found bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	shard := store.shard(key)
+	shard.mux.RLock()
+	defer shard.mux.RUnlock()
+	value, found = shard.storage[key]
+	return
+}
+
+func (store *mapStore) unset(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	shard := store.shard(key)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+	shard.remove(key)
+	return nil
+}
+
+func (store *mapStore) replace(ctx context.Context, oldKey, newKey string, fn func(*storeValue) error) (found bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	defer store.trim()
+	// Lock both shards, lowest index first so that concurrent replaces cannot deadlock
+	oldIndex, newIndex := store.shardIndex(oldKey), store.shardIndex(newKey)
+	first, second := oldIndex, newIndex
+	if first > second {
+		first, second = second, first
+	}
+	store.shards[first].mux.Lock()
+	defer store.shards[first].mux.Unlock()
+	if second != first {
+		store.shards[second].mux.Lock()
+		defer store.shards[second].mux.Unlock()
+	}
+
+	oldShard := store.shards[oldIndex]
+	value, found := oldShard.storage[oldKey]
+	if !found {
+		return
+	}
+	// Work on a copy, so that nothing changes if fn fails
+	value = value.clone()
+	if err = fn(&value); err != nil {
+		return
+	}
+	oldShard.remove(oldKey)
+	store.shards[newIndex].put(newKey, value)
+	return
+}
+
+func (store *mapStore) update(ctx context.Context, key string, fn func(*storeValue) error) (found bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	defer store.trim()
+	shard := store.shard(key)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+	value, found := shard.storage[key]
+	if !found {
+		return
+	}
+	// Work on a copy, so that nothing changes if fn fails
+	value = value.clone()
+	if err = fn(&value); err != nil {
+		return
+	}
+	shard.put(key, value)
+	return
+}
+
+func (store *mapStore) maxDataSize() int {
+	return mapStoreMaxDataSize
 }
 
-func (store mapStore) get(key string) (value storeValue, found bool) {
-	value, found = store.storage[key]
+func (store *mapStore) unsetAll(ctx context.Context, userID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, shard := range store.shards {
+		shard.mux.Lock()
+		for key := range shard.users[userID] {
+			shard.remove(key)
+		}
+		shard.mux.Unlock()
+	}
+	return nil
+}
+
+func (store *mapStore) userSessions(ctx context.Context, userID string) (sessions map[string]storeValue, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	sessions = make(map[string]storeValue)
+	for _, shard := range store.shards {
+		shard.mux.RLock()
+		for key := range shard.users[userID] {
+			sessions[key] = shard.storage[key]
+		}
+		shard.mux.RUnlock()
+	}
 	return
 }
 
-func (store mapStore) unset(key string) {
+func (store *mapStore) stats() StoreStats {
+	sessions := 0
+	for _, shard := range store.shards {
+		shard.mux.RLock()
+		sessions += len(shard.storage)
+		shard.mux.RUnlock()
+	}
+	return StoreStats{
+		Sessions:          sessions,
+		Evictions:         atomic.LoadUint64(&store.evictions),
+		CapacityEvictions: atomic.LoadUint64(&store.capacityEvictions),
+	}
+}
+
+// close stops the janitor, if it was started, and saves a final snapshot if they are enabled.
+func (store *mapStore) close() {
 	store.mux.Lock()
-	defer store.mux.Unlock()
-	delete(store.storage, key)
+	if store.stop != nil {
+		close(store.stop)
+		store.stop = nil
+	}
+	snapshots := store.snapshots
+	store.snapshots = nil
+	store.mux.Unlock()
+
+	if snapshots != nil {
+		close(snapshots.stop)
+		<-snapshots.done
+	}
 }
 
-func (store mapStore) unsetAll(userID string) {
-	for key, value := range store.storage {
-		if value.UserID == userID {
-			store.unset(key)
+// sweep evicts every session that is past its idle or forced expiry at the given time,
+// returning the number of sessions evicted. Shards are swept one at a time.
+func (store *mapStore) sweep(now time.Time) (evicted int) {
+	for _, shard := range store.shards {
+		shard.mux.Lock()
+		for key, value := range shard.storage {
+			if now.After(value.Expires) || now.After(value.MaxExpiry) {
+				shard.remove(key)
+				evicted++
+			}
 		}
+		shard.mux.Unlock()
+	}
+	atomic.AddUint64(&store.evictions, uint64(evicted))
+	return
+}
+
+// startJanitor runs sweep in the background at the given interval, reading the time
+// from the clock, until the store is closed. Calls made while the janitor is running
+// have no effect.
+func (store *mapStore) startJanitor(interval time.Duration, clock Clock) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	if store.stop != nil {
+		return
 	}
+	stop := make(chan struct{})
+	store.stop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				store.sweep(clock.Now())
+			}
+		}
+	}()
 }
@@ -1,6 +1,11 @@
 package authlib
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -11,17 +16,17 @@ func TestMapStore(t *testing.T) {
 	store := createMapStore()
 	key := randStr(64)
 	value := randStr(64)
-	store.set(key, storeValue{HashedToken: value})
-	valueFound, found := store.get(key)
+	store.set(context.Background(), key, storeValue{HashedToken: value})
+	valueFound, found, _ := store.get(context.Background(), key)
 	if !found {
 		t.Error("Could not retrieve key")
 	} else if valueFound.HashedToken != value {
 		t.Error("Wrong value retrieved")
 	}
 
-	store.unset(key)
+	store.unset(context.Background(), key)
 
-	valueFound, found = store.get(key)
+	valueFound, found, _ = store.get(context.Background(), key)
 	assert.False(t, found, "Should not have been able to retrieve key")
 
 	// Test unset all
@@ -31,17 +36,362 @@ func TestMapStore(t *testing.T) {
 		key := randStr(64)
 		keys = append(keys, key)
 		value := randStr(64)
-		store.set(key, storeValue{
+		store.set(context.Background(), key, storeValue{
 			HashedToken: value,
 			UserID:      id,
 			MaxExpiry:   time.Now().Add(time.Minute),
 		})
 	}
 
-	_, found = store.get(keys[0])
+	_, found, _ = store.get(context.Background(), keys[0])
 	assert.True(t, found, "Should be able to retrieve key")
 
-	store.unsetAll(id)
-	_, found = store.get(keys[0])
+	store.unsetAll(context.Background(), id)
+	_, found, _ = store.get(context.Background(), keys[0])
 	assert.False(t, found, "Should not be able to retrieve key")
 }
+
+func TestMapStoreReplace(t *testing.T) {
+	store := createMapStore()
+	ctx := context.Background()
+	oldKey, newKey := randStr(64), randStr(64)
+	store.set(ctx, oldKey, storeValue{HashedToken: "old"})
+
+	store.update(ctx, oldKey, func(value *storeValue) error {
+		value.Data = map[string][]byte{"org": []byte("42")}
+		return nil
+	})
+
+	found, err := store.replace(ctx, oldKey, newKey, func(value *storeValue) error {
+		value.HashedToken = "new"
+		return nil
+	})
+	assert.True(t, found, "Old key should have been found")
+	assert.Empty(t, err, "Error replacing key")
+	_, found, _ = store.get(ctx, oldKey)
+	assert.False(t, found, "Old key should be removed")
+	value, _, _ := store.get(ctx, newKey)
+	assert.Equal(t, "new", value.HashedToken, "New key should hold the changed value")
+	assert.Equal(t, []byte("42"), value.Data["org"], "Changes made before the move should carry over")
+
+	// Nothing changes if fn fails
+	failed := errors.New("failed")
+	found, err = store.replace(ctx, newKey, randStr(64), func(value *storeValue) error {
+		value.HashedToken = "changed"
+		return failed
+	})
+	assert.True(t, found, "Key should have been found")
+	assert.Equal(t, failed, err, "Error from fn should be returned")
+	value, found, _ = store.get(ctx, newKey)
+	assert.True(t, found, "Key should not be moved if fn fails")
+	assert.Equal(t, "new", value.HashedToken, "Value should not change if fn fails")
+
+	// Replacing a key that is gone does not bring it back
+	found, _ = store.replace(ctx, oldKey, randStr(64), func(*storeValue) error { return nil })
+	assert.False(t, found, "Removed key should not be found")
+	assert.Equal(t, 1, store.stats().Sessions, "No session should be added")
+}
+
+func TestMapStoreUpdate(t *testing.T) {
+	store := createMapStore()
+	ctx := context.Background()
+	key := randStr(64)
+	store.set(ctx, key, storeValue{Data: map[string][]byte{"a": []byte("1")}})
+
+	found, err := store.update(ctx, key, func(value *storeValue) error {
+		value.Data["a"] = []byte("2")
+		return errors.New("rejected")
+	})
+	assert.True(t, found, "Key should have been found")
+	assert.Error(t, err, "Error from fn should be returned")
+	value, _, _ := store.get(ctx, key)
+	assert.Equal(t, "1", string(value.Data["a"]), "Rejected update should not change the value")
+
+	found, _ = store.update(ctx, randStr(64), func(value *storeValue) error { return nil })
+	assert.False(t, found, "Missing key should not be found")
+}
+
+func TestMapStoreSweep(t *testing.T) {
+	now := time.Now()
+	store := createMapStore()
+
+	idle, forced, live := randStr(64), randStr(64), randStr(64)
+	store.set(context.Background(), idle, storeValue{Expires: now.Add(-time.Second), MaxExpiry: now.Add(time.Hour)})
+	store.set(context.Background(), forced, storeValue{Expires: now.Add(time.Minute), MaxExpiry: now.Add(-time.Second)})
+	store.set(context.Background(), live, storeValue{Expires: now.Add(time.Minute), MaxExpiry: now.Add(time.Hour)})
+
+	assert.Equal(t, 2, store.sweep(now), "Wrong number of sessions evicted")
+	_, found, _ := store.get(context.Background(), live)
+	assert.True(t, found, "Live session should not have been evicted")
+	_, found, _ = store.get(context.Background(), idle)
+	assert.False(t, found, "Idle session should have been evicted")
+
+	// Advance the clock past the idle timeout of the remaining session
+	assert.Equal(t, 1, store.sweep(now.Add(2*time.Minute)), "Wrong number of sessions evicted")
+	assert.Equal(t, StoreStats{Sessions: 0, Evictions: 3}, store.stats(), "Wrong store stats")
+}
+
+func TestMapStoreJanitor(t *testing.T) {
+	store := createMapStore()
+	store.set(context.Background(), randStr(64), storeValue{Expires: time.Now().Add(time.Hour), MaxExpiry: time.Now().Add(time.Hour)})
+	clock := newTestClock()
+	store.startJanitor(time.Millisecond, clock)
+	defer store.close()
+
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, uint64(0), store.stats().Evictions, "Janitor evicted a live session")
+
+	clock.advance(2 * time.Hour)
+
+	assert.Eventually(t, func() bool {
+		return store.stats().Evictions == 1
+	}, time.Second, time.Millisecond, "Janitor did not evict expired session")
+
+	// The janitor can be started again once the store is closed
+	store.close()
+	store.set(context.Background(), randStr(64), storeValue{Expires: clock.Now().Add(time.Hour), MaxExpiry: clock.Now().Add(time.Hour)})
+	store.startJanitor(time.Millisecond, clock)
+	clock.advance(2 * time.Hour)
+	assert.Eventually(t, func() bool {
+		return store.stats().Evictions == 2
+	}, time.Second, time.Millisecond, "Janitor was not restarted after closing")
+}
+
+func TestMapStoreSetLimited(t *testing.T) {
+	now := time.Now()
+	store := createMapStore()
+	ctx := context.Background()
+	userID := randStr(64)
+	session := func(established time.Duration) storeValue {
+		return storeValue{UserID: userID, Expires: now.Add(time.Hour), MaxExpiry: now.Add(established + time.Hour*24)}
+	}
+	limit := sessionLimit{max: 2, now: now}
+
+	store.set(ctx, "expired", storeValue{UserID: userID, Expires: now.Add(-time.Second), MaxExpiry: now.Add(time.Hour)})
+	store.set(ctx, "oldest", session(-time.Hour))
+	_, err := store.setLimited(ctx, "newer", session(0), limit)
+	assert.Empty(t, err, "Expired session should not count towards the limit")
+	_, found, _ := store.get(ctx, "expired")
+	assert.False(t, found, "Expired session should be evicted")
+
+	_, err = store.setLimited(ctx, "rejected", session(0), limit)
+	assert.ErrorIs(t, err, ErrTooManySessions, "Session over the limit should be rejected")
+	_, found, _ = store.get(ctx, "rejected")
+	assert.False(t, found, "Rejected session should not be stored")
+
+	limit.evictOldest = true
+	evicted, err := store.setLimited(ctx, "newest", session(time.Minute), limit)
+	assert.Empty(t, err, "Error evicting session")
+	assert.Equal(t, []string{"oldest"}, evicted, "Oldest session should be evicted")
+	sessions, _ := store.userSessions(ctx, userID)
+	assert.Len(t, sessions, 2, "Index should hold the user's sessions")
+
+	store.unset(ctx, "newer")
+	store.unset(ctx, "newest")
+	for _, shard := range store.shards {
+		assert.NotContains(t, shard.users, userID, "Index should be emptied with the sessions")
+	}
+}
+
+func TestMapStoreUserIndex(t *testing.T) {
+	store := createMapStore()
+	defer store.close()
+	ctx := context.Background()
+	userID, otherID := randStr(64), randStr(64)
+	expiry := time.Now().Add(time.Minute)
+	keys := []string{randStr(64), randStr(64), randStr(64)}
+	for _, key := range keys {
+		store.set(ctx, key, storeValue{UserID: userID, Expires: expiry, MaxExpiry: expiry})
+	}
+	otherKey := randStr(64)
+	store.set(ctx, otherKey, storeValue{UserID: otherID, Expires: expiry, MaxExpiry: expiry})
+
+	sessions, err := store.userSessions(ctx, userID)
+	assert.Empty(t, err, "Error listing sessions")
+	assert.Len(t, sessions, 3, "Only the user's sessions should be listed")
+	assert.NotContains(t, sessions, otherKey, "Other user's session should not be listed")
+
+	// Unset, replace and sweep keep the index up to date
+	store.unset(ctx, keys[0])
+	newKey := randStr(64)
+	store.replace(ctx, keys[1], newKey, func(*storeValue) error { return nil })
+	store.set(ctx, keys[2], storeValue{UserID: userID, Expires: time.Now().Add(-time.Second), MaxExpiry: expiry})
+	store.sweep(time.Now())
+	sessions, _ = store.userSessions(ctx, userID)
+	assert.Equal(t, []string{newKey}, mapKeys(sessions), "Index should follow unset, replace and expiry")
+
+	store.unsetAll(ctx, userID)
+	sessions, _ = store.userSessions(ctx, userID)
+	assert.Empty(t, sessions, "No sessions should be left after unsetAll")
+	for _, shard := range store.shards {
+		assert.NotContains(t, shard.users, userID, "Index entry should be removed with the last session")
+	}
+	_, found, _ := store.get(ctx, otherKey)
+	assert.True(t, found, "Other user's session should be kept")
+}
+
+func mapKeys(m map[string]storeValue) (keys []string) {
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return
+}
+
+// TestMapStoreConcurrent is meant to be run with -race.
+func TestMapStoreConcurrent(t *testing.T) {
+	store := createMapStore()
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Hour)
+	users := []string{randStr(16), randStr(16), randStr(16)}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				userID := users[i%len(users)]
+				key := userID + "-" + strconv.Itoa(worker) + "-" + strconv.Itoa(i)
+				store.set(ctx, key, storeValue{UserID: userID, Expires: expiry, MaxExpiry: expiry})
+				store.get(ctx, key)
+				store.update(ctx, key, func(value *storeValue) error {
+					value.Expires = value.Expires.Add(time.Second)
+					return nil
+				})
+				switch i % 4 {
+				case 1:
+					store.unset(ctx, key)
+				case 2:
+					store.replace(ctx, key, key+"-new", func(*storeValue) error { return nil })
+				case 3:
+					store.setLimited(ctx, key+"-limited", storeValue{UserID: userID, Expires: expiry, MaxExpiry: expiry}, sessionLimit{max: 50, evictOldest: true, now: time.Now()})
+				}
+				if i%50 == 0 {
+					store.unsetAll(ctx, userID)
+				}
+				store.userSessions(ctx, userID)
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	// The index matches the sessions held
+	indexed := 0
+	for _, userID := range users {
+		sessions, err := store.userSessions(ctx, userID)
+		assert.Empty(t, err, "Error listing sessions")
+		for key, value := range sessions {
+			assert.Equal(t, userID, value.UserID, "Indexed session %s should belong to its user", key)
+		}
+		indexed += len(sessions)
+	}
+	assert.Equal(t, store.stats().Sessions, indexed, "Every session should be indexed")
+}
+
+// benchmarkMapStore runs a read-heavy mix, as from CheckLogin, against a store
+// with the given number of shards. A single shard serialises every request
+// behind one lock, as the store did before it was sharded.
+func benchmarkMapStore(b *testing.B, shards int) {
+	store := newMapStore(shards)
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Hour)
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = randStr(64)
+		store.set(ctx, keys[i], storeValue{UserID: strconv.Itoa(i % 64), Expires: expiry, MaxExpiry: expiry})
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if i%10 == 0 {
+				store.update(ctx, key, func(value *storeValue) error {
+					value.Expires = expiry
+					return nil
+				})
+			} else {
+				store.get(ctx, key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkMapStoreSingleLock(b *testing.B) {
+	benchmarkMapStore(b, 1)
+}
+
+func BenchmarkMapStoreSharded(b *testing.B) {
+	benchmarkMapStore(b, mapStoreShards)
+}
+
+func TestMapStoreCapacity(t *testing.T) {
+	store := newMapStore(1)
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Hour)
+	var evicted []string
+	store.setCapacity(3, func(key string, value storeValue) {
+		evicted = append(evicted, key)
+		// The store can be used from the callback
+		store.get(ctx, key)
+	})
+
+	for _, key := range []string{"a", "b", "c"} {
+		store.set(ctx, key, storeValue{UserID: key, Expires: expiry, MaxExpiry: expiry})
+	}
+	// Refreshing a session makes it the most recently used
+	store.update(ctx, "a", func(value *storeValue) error { return nil })
+	store.set(ctx, "d", storeValue{UserID: "d", Expires: expiry, MaxExpiry: expiry})
+	assert.Equal(t, []string{"b"}, evicted, "Least recently used session should be evicted")
+	_, found, _ := store.get(ctx, "b")
+	assert.False(t, found, "Evicted session should be removed")
+	sessions, _ := store.userSessions(ctx, "b")
+	assert.Empty(t, sessions, "Evicted session should be removed from the index")
+
+	store.replace(ctx, "c", "e", func(*storeValue) error { return nil })
+	assert.Equal(t, []string{"b"}, evicted, "Replacing a session should not evict another")
+	store.set(ctx, "f", storeValue{UserID: "f", Expires: expiry, MaxExpiry: expiry})
+	assert.Equal(t, []string{"b", "a"}, evicted, "Least recently used session should be evicted")
+
+	stats := store.stats()
+	assert.Equal(t, 3, stats.Sessions, "Store should stay within its capacity")
+	assert.Equal(t, uint64(2), stats.CapacityEvictions, "Evictions should be counted")
+	assert.Zero(t, stats.Evictions, "Capacity evictions should not count as expired")
+
+	// Without a capacity, nothing more is evicted
+	store.setCapacity(0, nil)
+	store.set(ctx, "g", storeValue{UserID: "g", Expires: expiry, MaxExpiry: expiry})
+	assert.Equal(t, 4, store.stats().Sessions, "Store should no longer be bounded")
+}
+
+func TestMapStoreCapacityShards(t *testing.T) {
+	store := createMapStore()
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Hour)
+	var evicted []string
+	store.setCapacity(100, func(key string, value storeValue) {
+		evicted = append(evicted, key)
+	})
+
+	// Sessions spread across the shards, so most shards hold only a few of them
+	keys := make([]string, 101)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("session-%d", i)
+		store.set(ctx, keys[i], storeValue{UserID: keys[i], Expires: expiry, MaxExpiry: expiry})
+	}
+	assert.Equal(t, []string{keys[0]}, evicted, "Only the oldest session should be evicted")
+	assert.Equal(t, 100, store.stats().Sessions, "Store should hold its capacity")
+	for _, key := range keys[1:] {
+		_, found, _ := store.get(ctx, key)
+		assert.True(t, found, "Sessions within the capacity should be kept")
+	}
+
+	// Lowering the capacity evicts the oldest sessions at once
+	store.setCapacity(10, func(key string, value storeValue) {
+		evicted = append(evicted, key)
+	})
+	assert.Equal(t, keys[:91], evicted, "Oldest sessions should be evicted first")
+	assert.Equal(t, 10, store.stats().Sessions, "Store should hold its new capacity")
+}
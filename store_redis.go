@@ -1,91 +1,365 @@
 package authlib
 
-// import (
-// 	"bytes"
-// 	"encoding/gob"
-// 	"time"
-
-// 	"github.com/gomodule/redigo/redis"
-// )
-
-// type redisStore struct {
-// 	pool      *redis.Pool
-// 	namespace string
-// }
-
-// func encodeGob(v storeValue) []byte {
-// 	var buf bytes.Buffer
-// 	enc := gob.NewEncoder(&buf)
-// 	err := enc.Encode(v)
-// 	if err != nil {
-// 		panic(err)
-// 	}
-
-// 	return buf.Bytes()
-// }
-
-// func decodeGob(b []byte, result *storeValue) {
-// 	buf := bytes.NewBuffer(b)
-// 	enc := gob.NewDecoder(buf)
-// 	err := enc.Decode(result)
-// 	if err != nil {
-// 		panic(err)
-// 	}
-// }
-
-// func createRedisStore(connStr, namespace string) (redisStore, error) {
-// 	pool := &redis.Pool{
-// 		MaxIdle:     3,
-// 		IdleTimeout: 5 * time.Second,
-// 		Wait:        true,
-// 		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", connStr, redis.DialConnectTimeout(1*time.Second)) },
-// 	}
-
-// 	if _, err := pool.Get().Do("PING"); err != nil {
-// 		return redisStore{}, err
-// 	}
-
-// 	return redisStore{pool: pool, namespace: namespace}, nil
-// }
-
-// func (store redisStore) formatKey(key string) string {
-// 	return store.namespace + "#" + key
-// }
-
-// func (store redisStore) set(key string, value storeValue) {
-// 	conn := store.pool.Get()
-// 	defer conn.Close()
-// 	conn.Do("SET", store.formatKey(key), encodeGob(value))
-// 	conn.Do("EXPIREAT", store.formatKey(key), value.MaxExpiry.Unix())
-// }
-
-// func (store redisStore) get(key string) (value storeValue, found bool) {
-// 	conn := store.pool.Get()
-// 	defer conn.Close()
-// 	encodedVal, err := redis.Bytes(conn.Do("GET", store.formatKey(key)))
-// 	if encodedVal == nil || err != nil {
-// 		return storeValue{}, false
-// 	}
-// 	decodeGob(encodedVal, &value)
-// 	return value, true
-// }
-
-// func (store redisStore) unset(key string) {
-// 	conn := store.pool.Get()
-// 	defer conn.Close()
-// 	conn.Do("DEL", store.formatKey(key))
-// }
-
-// func (store redisStore) unsetAll(userID string) {
-// 	conn := store.pool.Get()
-// 	defer conn.Close()
-// 	keys, err := redis.Strings(conn.Do("KEYS", store.formatKey(userID+"-*")))
-// 	if err != nil {
-// 		return
-// 	}
-// 	s := make([]interface{}, len(keys))
-// 	for i, v := range keys {
-// 		s[i] = v
-// 	}
-// 	conn.Do("DEL", s...)
-// }
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisMaxDataSize bounds the session data sent to and from Redis on every request.
+const redisMaxDataSize = 512 << 10
+
+// redisStore keeps sessions in Redis, so that they are shared between instances
+// of the app and survive restarts. Redis expires each session by itself, at its
+// idle or forced expiry, whichever comes first.
+type redisStore struct {
+	pool      *redis.Pool
+	namespace string
+}
+
+func encodeGob(v storeValue) []byte {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return buf.Bytes()
+}
+
+func decodeGob(b []byte, result *storeValue) error {
+	if err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(result); err != nil {
+		return fmt.Errorf("could not decode session: %w", err)
+	}
+	return nil
+}
+
+// createRedisStore connects to the Redis server at connStr, either an address
+// such as localhost:6379, or a URL such as redis://:password@localhost:6379/0.
+func createRedisStore(connStr, namespace string) (redisStore, error) {
+	dial := func() (redis.Conn, error) {
+		if strings.Contains(connStr, "://") {
+			return redis.DialURL(connStr, redis.DialConnectTimeout(1*time.Second))
+		}
+		return redis.Dial("tcp", connStr, redis.DialConnectTimeout(1*time.Second))
+	}
+	pool := &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 5 * time.Second,
+		Wait:        true,
+		Dial:        dial,
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		pool.Close()
+		return redisStore{}, err
+	}
+
+	return redisStore{pool: pool, namespace: namespace}, nil
+}
+
+// formatKey returns the Redis key holding the session with the given key.
+func (store redisStore) formatKey(key string) string {
+	return store.namespace + "#session#" + key
+}
+
+// sessionKey is the inverse of formatKey.
+func (store redisStore) sessionKey(redisKey string) string {
+	return strings.TrimPrefix(redisKey, store.formatKey(""))
+}
+
+// userIndex is the sorted set of the keys of a user's sessions, scored by their forced
+// expiry, as returned by indexScore. It expires along with the last of its sessions.
+func (store redisStore) userIndex(userID string) string {
+	return store.namespace + "#user#" + userID
+}
+
+// userOf returns the user ID that a session key is prefixed with.
+func userOf(key string) string {
+	if len(key) <= sessionKeyLength {
+		return ""
+	}
+	return key[:len(key)-sessionKeyLength-1]
+}
+
+func (store redisStore) set(ctx context.Context, key string, value storeValue) error {
+	conn, err := store.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.Send("MULTI")
+	store.write(conn, key, value)
+	_, err = redis.DoContext(conn, ctx, "EXEC")
+	return err
+}
+
+// write queues the commands storing a session on conn, typically within a transaction.
+func (store redisStore) write(conn redis.Conn, key string, value storeValue) {
+	conn.Send("SET", store.formatKey(key), encodeGob(value))
+	conn.Send("PEXPIREAT", store.formatKey(key), redisExpiry(value))
+	conn.Send("ZADD", store.userIndex(value.UserID), indexScore(value.MaxExpiry), store.formatKey(key))
+	trimIndexScript.Send(conn, store.userIndex(value.UserID), indexScore(time.Now()))
+}
+
+// trimIndexLua defines trim, which drops the sessions past their forced expiry from a
+// user index, so that it does not grow while the user keeps logging in, and expires
+// the index along with the session in it that expires last. It is shared by the
+// scripts that add to an index.
+const trimIndexLua = `
+local function trim(index, now)
+	redis.call("ZREMRANGEBYSCORE", index, "-inf", now)
+	local last = redis.call("ZRANGE", index, -1, -1, "WITHSCORES")
+	if #last > 0 then
+		redis.call("PEXPIREAT", index, math.ceil(tonumber(last[2]) / 1000))
+	end
+end
+`
+
+var trimIndexScript = redis.NewScript(1, trimIndexLua+`
+trim(KEYS[1], ARGV[1])
+`)
+
+// indexScore returns the score of a time in the user index, in Unix microseconds, so that
+// sessions established in the same second keep their order. Scores are held as doubles,
+// which are exact up to 2^53.
+func indexScore(t time.Time) int64 {
+	return t.UnixMicro()
+}
+
+// redisExpiry returns the time, in Unix milliseconds, that Redis should expire a session at.
+// Sessions are refreshed before their idle expiry, so that they live until their forced expiry.
+func redisExpiry(value storeValue) int64 {
+	if value.Expires.IsZero() || value.Expires.After(value.MaxExpiry) {
+		return value.MaxExpiry.UnixMilli()
+	}
+	return value.Expires.UnixMilli()
+}
+
+// setLimitedScript sets a session, first making room in the index of its user.
+// Keys that have expired are dropped from the index, and the sessions with the
+// earliest forced expiry are evicted if needed. Returns the keys evicted, or an
+// error reply if the user is at the limit and eviction is not allowed. It runs
+// atomically, so concurrent logins of a user cannot exceed the limit together.
+var setLimitedScript = redis.NewScript(2, trimIndexLua+`
+local index, key = KEYS[1], KEYS[2]
+local value, expiresAt, maxExpiry, max, evict, now = ARGV[1], ARGV[2], ARGV[3], tonumber(ARGV[4]), ARGV[5] == "1", ARGV[6]
+trim(index, now)
+for _, member in ipairs(redis.call("ZRANGE", index, 0, -1)) do
+	if redis.call("EXISTS", member) == 0 then
+		redis.call("ZREM", index, member)
+	end
+end
+local evicted = {}
+local count = redis.call("ZCARD", index)
+if count >= max then
+	if not evict then
+		return redis.error_reply("too many sessions")
+	end
+	evicted = redis.call("ZRANGE", index, 0, count - max)
+	for _, member in ipairs(evicted) do
+		redis.call("DEL", member)
+		redis.call("ZREM", index, member)
+	end
+end
+redis.call("SET", key, value)
+redis.call("PEXPIREAT", key, expiresAt)
+redis.call("ZADD", index, maxExpiry, key)
+trim(index, now)
+return evicted
+`)
+
+func (store redisStore) setLimited(ctx context.Context, key string, value storeValue, limit sessionLimit) (evicted []string, err error) {
+	conn, err := store.pool.GetContext(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	evict := "0"
+	if limit.evictOldest {
+		evict = "1"
+	}
+	// Redis drops sessions past their idle expiry by itself, so like those past their
+	// forced expiry, they no longer exist and do not count towards the limit
+	keys, err := redis.Strings(setLimitedScript.DoContext(ctx, conn, store.userIndex(value.UserID), store.formatKey(key),
+		encodeGob(value), redisExpiry(value), indexScore(value.MaxExpiry), limit.max, evict, indexScore(limit.now)))
+	if redisErr, ok := err.(redis.Error); ok && redisErr.Error() == "too many sessions" {
+		return nil, ErrTooManySessions
+	}
+	for _, evictedKey := range keys {
+		evicted = append(evicted, store.sessionKey(evictedKey))
+	}
+	return evicted, err
+}
+
+func (store redisStore) get(ctx context.Context, key string) (value storeValue, found bool, err error) {
+	conn, err := store.pool.GetContext(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	encodedVal, err := redis.Bytes(redis.DoContext(conn, ctx, "GET", store.formatKey(key)))
+	if err == redis.ErrNil {
+		return storeValue{}, false, nil
+	}
+	if err != nil {
+		return storeValue{}, false, err
+	}
+	if err = decodeGob(encodedVal, &value); err != nil {
+		return storeValue{}, false, err
+	}
+	return value, true, nil
+}
+
+func (store redisStore) unset(ctx context.Context, key string) error {
+	conn, err := store.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("DEL", store.formatKey(key))
+	conn.Send("ZREM", store.userIndex(userOf(key)), store.formatKey(key))
+	_, err = redis.DoContext(conn, ctx, "EXEC")
+	return err
+}
+
+// modify applies fn to the session held at key, then queues the writes of write in a
+// transaction, retrying until the key is not changed by anyone else in between.
+func (store redisStore) modify(ctx context.Context, conn redis.Conn, key string, fn func(*storeValue) error,
+	write func(value storeValue)) (found bool, err error) {
+	for {
+		if _, err = redis.DoContext(conn, ctx, "WATCH", store.formatKey(key)); err != nil {
+			return
+		}
+		encodedVal, err := redis.Bytes(redis.DoContext(conn, ctx, "GET", store.formatKey(key)))
+		if err == redis.ErrNil {
+			redis.DoContext(conn, ctx, "UNWATCH")
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		var value storeValue
+		if err = decodeGob(encodedVal, &value); err != nil {
+			redis.DoContext(conn, ctx, "UNWATCH")
+			return false, err
+		}
+		if err = fn(&value); err != nil {
+			redis.DoContext(conn, ctx, "UNWATCH")
+			return true, err
+		}
+		conn.Send("MULTI")
+		write(value)
+		reply, err := redis.DoContext(conn, ctx, "EXEC")
+		if err != nil {
+			return true, err
+		}
+		if reply != nil {
+			return true, nil
+		}
+	}
+}
+
+func (store redisStore) replace(ctx context.Context, oldKey, newKey string, fn func(*storeValue) error) (found bool, err error) {
+	conn, err := store.pool.GetContext(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	return store.modify(ctx, conn, oldKey, fn, func(value storeValue) {
+		conn.Send("DEL", store.formatKey(oldKey))
+		conn.Send("ZREM", store.userIndex(value.UserID), store.formatKey(oldKey))
+		store.write(conn, newKey, value)
+	})
+}
+
+func (store redisStore) update(ctx context.Context, key string, fn func(*storeValue) error) (found bool, err error) {
+	conn, err := store.pool.GetContext(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	return store.modify(ctx, conn, key, fn, func(value storeValue) {
+		store.write(conn, key, value)
+	})
+}
+
+func (store redisStore) maxDataSize() int {
+	return redisMaxDataSize
+}
+
+// unsetAllScript deletes every session in the index of a user, along with the index.
+// It runs atomically, so a session stored meanwhile is either deleted or left in the index.
+var unsetAllScript = redis.NewScript(1, `
+for _, member in ipairs(redis.call("ZRANGE", KEYS[1], 0, -1)) do
+	redis.call("DEL", member)
+end
+redis.call("DEL", KEYS[1])
+`)
+
+func (store redisStore) unsetAll(ctx context.Context, userID string) error {
+	conn, err := store.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = unsetAllScript.DoContext(ctx, conn, store.userIndex(userID))
+	return err
+}
+
+func (store redisStore) userSessions(ctx context.Context, userID string) (sessions map[string]storeValue, err error) {
+	conn, err := store.pool.GetContext(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	// Sessions past their forced expiry are gone, so they are dropped before reading
+	if _, err = redis.DoContext(conn, ctx, "ZREMRANGEBYSCORE", store.userIndex(userID), "-inf", indexScore(time.Now())); err != nil {
+		return nil, err
+	}
+	keys, err := redis.Strings(redis.DoContext(conn, ctx, "ZRANGE", store.userIndex(userID), 0, -1))
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	s := make([]interface{}, len(keys))
+	for i, v := range keys {
+		s[i] = v
+	}
+	values, err := redis.ByteSlices(redis.DoContext(conn, ctx, "MGET", s...))
+	if err != nil {
+		return nil, err
+	}
+	sessions = make(map[string]storeValue, len(keys))
+	for i, encodedVal := range values {
+		if encodedVal == nil {
+			// Expired by Redis, so drop it from the index
+			redis.DoContext(conn, ctx, "ZREM", store.userIndex(userID), keys[i])
+			continue
+		}
+		var value storeValue
+		if err = decodeGob(encodedVal, &value); err != nil {
+			return nil, err
+		}
+		sessions[store.sessionKey(keys[i])] = value
+	}
+	return sessions, nil
+}
+
+// stats reports nothing, as Redis expires sessions by itself, and counting them would
+// mean scanning every key. The session gauge is not registered for Redis.
+func (store redisStore) stats() (stats StoreStats) {
+	return
+}
+
+func (store redisStore) close() {
+	store.pool.Close()
+}
@@ -1,83 +1,421 @@
 package authlib
 
-// import (
-// 	"testing"
-// 	"time"
-
-// 	"github.com/stretchr/testify/assert"
-// )
-
-// func TestRedisStore(t *testing.T) {
-// 	store, err := createRedisStore(":6379", randStr(8))
-// 	defer store.pool.Close()
-// 	if assert.Empty(t, err, "unable to instantiate redis store") {
-// 		key := randStr(64)
-// 		value := randStr(64)
-// 		store.set(key, storeValue{
-// 			HashedToken: value,
-// 			MaxExpiry:   time.Now().Add(time.Minute),
-// 		})
-// 		valueFound, found := store.get(key)
-// 		if !found {
-// 			t.Error("Could not retrieve key")
-// 		} else if valueFound.HashedToken != value {
-// 			t.Error("Wrong value retrieved")
-// 		}
-
-// 		store.unset(key)
-
-// 		valueFound, found = store.get(key)
-// 		assert.False(t, found, "Should not have been able to retrieve key")
-
-// 		id := randStr(64)
-// 		keys := make([]string, 0)
-// 		for i := 0; i < 5; i++ {
-// 			key := randStr(64)
-// 			keys = append(keys, key)
-// 			value := randStr(64)
-// 			store.set(id+"-"+key, storeValue{
-// 				HashedToken: value,
-// 				UserID:      id,
-// 				MaxExpiry:   time.Now().Add(time.Minute),
-// 			})
-// 		}
-
-// 		_, found = store.get(id + "-" + keys[0])
-// 		assert.True(t, found, "Should be able to retrieve key")
-
-// 		store.unsetAll(id)
-// 		_, found = store.get(id + "-" + keys[0])
-// 		assert.False(t, found, "Should not be able to retrieve key")
-
-// 		// Test expiry
-// 		store.set(key, storeValue{
-// 			HashedToken: value,
-// 			MaxExpiry:   time.Now().Add(-time.Minute),
-// 		})
-// 		_, found = store.get(key)
-// 		assert.False(t, found, "Should not have been able to retrieve token")
-// 	}
-// }
-
-// func TestMultipleRedisStores(t *testing.T) {
-// 	store1, err1 := createRedisStore(":6379", randStr(8))
-// 	assert.Empty(t, err1, "Error creating redis store 1")
-// 	store2, err2 := createRedisStore(":6379", randStr(8))
-// 	assert.Empty(t, err2, "Error creating redis store 2")
-
-// 	defer store1.pool.Close()
-// 	defer store2.pool.Close()
-
-// 	key := randStr(64)
-// 	value := randStr(64)
-
-// 	store1.set(key, storeValue{
-// 		HashedToken: value,
-// 		MaxExpiry:   time.Now().Add(time.Minute),
-// 	})
-
-// 	_, found := store1.get(key)
-// 	assert.True(t, found, "Could not retrieve key from correct store")
-// 	_, found = store2.get(key)
-// 	assert.False(t, found, "Should not have retrieved key from wrong store")
-// }
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// testRedisStore starts an in-memory Redis server for the test, and a store using it.
+func testRedisStore(t *testing.T) (redisStore, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	store, err := createRedisStore(server.Addr(), randStr(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.close)
+	return store, server
+}
+
+// redisSessionKeys returns the keys of the sessions that the server holds for the store.
+func redisSessionKeys(server *miniredis.Miniredis, store redisStore) (keys []string) {
+	for _, key := range server.Keys() {
+		if strings.HasPrefix(key, store.formatKey("")) {
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+func TestRedisStore(t *testing.T) {
+	store, server := testRedisStore(t)
+	ctx := context.Background()
+	key := randStr(64)
+	value := randStr(64)
+	store.set(ctx, key, storeValue{
+		HashedToken: value,
+		MaxExpiry:   time.Now().Add(time.Minute),
+	})
+	valueFound, found, err := store.get(ctx, key)
+	assert.Empty(t, err, "Error retrieving key")
+	assert.True(t, found, "Could not retrieve key")
+	assert.Equal(t, value, valueFound.HashedToken, "Wrong value retrieved")
+	assert.Len(t, redisSessionKeys(server, store), 1, "Session should be held")
+
+	store.unset(ctx, key)
+	_, found, _ = store.get(ctx, key)
+	assert.False(t, found, "Should not have been able to retrieve key")
+
+	id := randStr(64)
+	keys := make([]string, 0)
+	for i := 0; i < 5; i++ {
+		key := id + "-" + randStr(sessionKeyLength)
+		keys = append(keys, key)
+		store.set(ctx, key, storeValue{
+			HashedToken: randStr(64),
+			UserID:      id,
+			MaxExpiry:   time.Now().Add(time.Minute),
+		})
+	}
+	sessions, err := store.userSessions(ctx, id)
+	assert.Empty(t, err, "Error listing sessions")
+	assert.Len(t, sessions, 5, "Every session of the user should be listed")
+	assert.Contains(t, sessions, keys[0], "Sessions should be listed by key")
+
+	store.unset(ctx, keys[1])
+	sessions, _ = store.userSessions(ctx, id)
+	assert.NotContains(t, sessions, keys[1], "Unset session should leave the index")
+
+	store.unsetAll(ctx, id)
+	_, found, _ = store.get(ctx, keys[0])
+	assert.False(t, found, "Should not be able to retrieve key")
+	assert.Empty(t, redisSessionKeys(server, store), "No session should be left")
+
+	// Redis expires sessions at their forced expiry
+	store.set(ctx, key, storeValue{
+		HashedToken: value,
+		MaxExpiry:   time.Now().Add(time.Minute),
+	})
+	server.FastForward(2 * time.Minute)
+	_, found, _ = store.get(ctx, key)
+	assert.False(t, found, "Should not have been able to retrieve expired session")
+}
+
+func TestMultipleRedisStores(t *testing.T) {
+	store1, server := testRedisStore(t)
+	store2, err := createRedisStore(server.Addr(), randStr(8))
+	assert.Empty(t, err, "Error creating redis store 2")
+	defer store2.close()
+	ctx := context.Background()
+
+	key := randStr(64)
+	store1.set(ctx, key, storeValue{
+		HashedToken: randStr(64),
+		MaxExpiry:   time.Now().Add(time.Minute),
+	})
+
+	_, found, _ := store1.get(ctx, key)
+	assert.True(t, found, "Could not retrieve key from correct store")
+	_, found, _ = store2.get(ctx, key)
+	assert.False(t, found, "Should not have retrieved key from wrong store")
+	assert.Empty(t, redisSessionKeys(server, store2), "Sessions should be kept in their own namespace")
+}
+
+func TestCreateRedisStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireAuth("secret")
+	store, err := createRedisStore("redis://:secret@"+server.Addr(), randStr(8))
+	if assert.Empty(t, err, "Error connecting with a URL") {
+		store.close()
+	}
+	_, err = createRedisStore("redis://:wrong@"+server.Addr(), randStr(8))
+	assert.Error(t, err, "Wrong password should be reported")
+
+	addr := server.Addr()
+	server.Close()
+	_, err = createRedisStore(addr, randStr(8))
+	assert.Error(t, err, "Unreachable server should be reported")
+	assert.Equal(t, "redis://:xxxxx@localhost:6379", redactConn("redis://:secret@localhost:6379"), "Password should not be logged")
+}
+
+func TestRedisStoreUpdate(t *testing.T) {
+	store, _ := testRedisStore(t)
+	ctx := context.Background()
+	key := randStr(64)
+	store.set(ctx, key, storeValue{HashedToken: "token", MaxExpiry: time.Now().Add(time.Minute)})
+
+	found, err := store.update(ctx, key, func(value *storeValue) error {
+		value.Data = map[string][]byte{"org": []byte("42")}
+		return nil
+	})
+	assert.True(t, found, "Key should have been found")
+	assert.Empty(t, err, "Error updating session")
+	value, _, _ := store.get(ctx, key)
+	assert.Equal(t, []byte("42"), value.Data["org"], "Update should be saved")
+	assert.Equal(t, "token", value.HashedToken, "Other fields should be kept")
+
+	// Nothing changes if fn fails
+	failed := errors.New("failed")
+	found, err = store.update(ctx, key, func(value *storeValue) error {
+		value.Data["org"] = []byte("43")
+		return failed
+	})
+	assert.True(t, found, "Key should have been found")
+	assert.Equal(t, failed, err, "Error from fn should be returned")
+	value, _, _ = store.get(ctx, key)
+	assert.Equal(t, []byte("42"), value.Data["org"], "Failed update should not be saved")
+
+	found, err = store.update(ctx, randStr(64), func(*storeValue) error { return nil })
+	assert.False(t, found, "Missing key should not be found")
+	assert.Empty(t, err, "Missing key is not an error")
+
+	// Concurrent updates are retried rather than lost
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				store.update(ctx, key, func(value *storeValue) error {
+					value.Data["count"] = append(value.Data["count"], 'x')
+					return nil
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	value, _, _ = store.get(ctx, key)
+	assert.Len(t, value.Data["count"], 80, "Every concurrent update should be applied")
+}
+
+func TestRedisStoreReplace(t *testing.T) {
+	store, server := testRedisStore(t)
+	ctx := context.Background()
+	userID := randStr(64)
+	oldKey, newKey := userID+"-"+randStr(sessionKeyLength), userID+"-"+randStr(sessionKeyLength)
+	store.set(ctx, oldKey, storeValue{UserID: userID, HashedToken: "old", MaxExpiry: time.Now().Add(time.Minute)})
+
+	found, err := store.replace(ctx, oldKey, newKey, func(value *storeValue) error {
+		value.HashedToken = "new"
+		return nil
+	})
+	assert.True(t, found, "Old key should have been found")
+	assert.Empty(t, err, "Error replacing key")
+	_, found, _ = store.get(ctx, oldKey)
+	assert.False(t, found, "Old key should be removed")
+	value, _, _ := store.get(ctx, newKey)
+	assert.Equal(t, "new", value.HashedToken, "New key should hold the changed value")
+	sessions, _ := store.userSessions(ctx, userID)
+	assert.Equal(t, []string{newKey}, mapKeys(sessions), "Index should follow the session")
+
+	// Replacing a key that is gone does not bring it back
+	found, _ = store.replace(ctx, oldKey, randStr(64), func(*storeValue) error { return nil })
+	assert.False(t, found, "Removed key should not be found")
+	assert.Len(t, redisSessionKeys(server, store), 1, "No session should be added")
+}
+
+func TestRedisStoreSessionData(t *testing.T) {
+	store, server := testRedisStore(t)
+	a := testObject()
+	a.store = store
+	ctx := context.Background()
+	recorder := httptest.NewRecorder()
+	_, err := a.saveLogin(ctx, saveLoginOpts{w: recorder, userID: randStr(64)})
+	assert.Empty(t, err, "Error saving login")
+	session, err := a.sessionOf(ctx, &http.Request{Header: http.Header{"Cookie": recorder.Result().Header["Set-Cookie"]}})
+	assert.Empty(t, err, "Error reading session")
+
+	// Redis holds more data than the map store
+	assert.Empty(t, session.Set(ctx, "large", strings.Repeat("x", mapStoreMaxDataSize)), "Error storing data")
+	var large string
+	found, err := session.Get(ctx, "large", &large)
+	assert.True(t, found, "Data should be stored in Redis")
+	assert.Empty(t, err, "Error reading data")
+	err = session.Set(ctx, "larger", strings.Repeat("x", redisMaxDataSize))
+	assert.ErrorIs(t, err, ErrSessionDataTooLarge, "Data past the Redis limit should be rejected")
+
+	// Outages are reported as such
+	server.Close()
+	err = session.Set(ctx, "org", 42)
+	assert.ErrorIs(t, err, ErrStoreUnavailable, "Redis outage should be reported")
+}
+
+func TestRedisStoreSetLimited(t *testing.T) {
+	store, server := testRedisStore(t)
+	ctx := context.Background()
+	userID := randStr(64)
+	now := time.Now()
+	session := func(maxExpiry time.Duration) (string, storeValue) {
+		return userID + "-" + randStr(sessionKeyLength), storeValue{UserID: userID, Expires: now.Add(time.Minute), MaxExpiry: now.Add(maxExpiry)}
+	}
+	limit := sessionLimit{max: 2, now: now}
+
+	oldest, value := session(time.Hour)
+	_, err := store.setLimited(ctx, oldest, value, limit)
+	assert.Empty(t, err, "Error saving first session")
+	newer, value := session(2 * time.Hour)
+	_, err = store.setLimited(ctx, newer, value, limit)
+	assert.Empty(t, err, "Error saving second session")
+
+	// At the limit, new sessions are refused
+	key, value := session(3 * time.Hour)
+	_, err = store.setLimited(ctx, key, value, limit)
+	assert.ErrorIs(t, err, ErrTooManySessions, "Session over the limit should be refused")
+	_, found, _ := store.get(ctx, key)
+	assert.False(t, found, "Refused session should not be stored")
+
+	// Or make room by evicting the session established first
+	limit.evictOldest = true
+	evicted, err := store.setLimited(ctx, key, value, limit)
+	assert.Empty(t, err, "Error saving session over the limit")
+	assert.Equal(t, []string{oldest}, evicted, "Oldest session should be evicted")
+	sessions, _ := store.userSessions(ctx, userID)
+	assert.ElementsMatch(t, []string{newer, key}, mapKeys(sessions), "Index should hold the sessions within the limit")
+
+	// Sessions past their idle expiry do not count
+	idle, value := session(time.Hour)
+	value.Expires = now.Add(time.Second)
+	store.unsetAll(ctx, userID)
+	store.set(ctx, idle, value)
+	server.FastForward(2 * time.Second)
+	limit = sessionLimit{max: 1, now: now.Add(2 * time.Second)}
+	key, value = session(time.Hour)
+	evicted, err = store.setLimited(ctx, key, value, limit)
+	assert.Empty(t, err, "Idle session should not count towards the limit")
+	assert.Empty(t, evicted, "Idle session should not be reported as evicted")
+	sessions, _ = store.userSessions(ctx, userID)
+	assert.Equal(t, []string{key}, mapKeys(sessions), "Idle session should be dropped from the index")
+}
+
+func TestRedisStoreSetLimitedConcurrent(t *testing.T) {
+	store, _ := testRedisStore(t)
+	ctx := context.Background()
+	userID := randStr(64)
+	expiry := time.Now().Add(time.Hour)
+
+	// Concurrent logins cannot exceed the limit together
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	accepted := 0
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.setLimited(ctx, userID+"-"+randStr(sessionKeyLength), storeValue{UserID: userID, Expires: expiry, MaxExpiry: expiry},
+				sessionLimit{max: 3, now: time.Now()})
+			if err == nil {
+				mux.Lock()
+				accepted++
+				mux.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 3, accepted, "Only as many sessions as the limit should be accepted")
+	sessions, _ := store.userSessions(ctx, userID)
+	assert.Len(t, sessions, 3, "User should hold as many sessions as the limit")
+}
+
+func TestRedisMaxSessionsPerUser(t *testing.T) {
+	store, _ := testRedisStore(t)
+	audit := &MemoryAuditSink{}
+	clock := newTestClock()
+	config := testObject().config
+	config.Clock = clock
+	config.MaxSessionsPerUser = 1
+	config.AuditSink = audit
+	a := New(config)
+	a.store = store
+	ctx := context.Background()
+
+	userID := randStr(64)
+	first, _, err := a.saveLoginInStore(ctx, userID, AuthPassword)
+	assert.Empty(t, err, "Error saving first session")
+	clock.advance(time.Second)
+	second, _, err := a.saveLoginInStore(ctx, userID, AuthPassword)
+	assert.Empty(t, err, "Error saving second session")
+	_, found, _ := store.get(ctx, first)
+	assert.False(t, found, "First session should be evicted")
+	_, found, _ = store.get(ctx, second)
+	assert.True(t, found, "Second session should be kept")
+	events := audit.Events()
+	if assert.NotEmpty(t, events, "Eviction should be audited") {
+		assert.Equal(t, AuditSessionEvicted, events[len(events)-1].Type, "Eviction should be audited")
+		assert.Equal(t, sessionID(first), events[len(events)-1].SessionID, "Evicted session should be named")
+	}
+}
+
+func TestRedisUserIndexExpiry(t *testing.T) {
+	store, server := testRedisStore(t)
+	ctx := context.Background()
+	userID := randStr(64)
+	index := store.userIndex(userID)
+	now := time.Now()
+	set := func(maxExpiry time.Duration) string {
+		key := userID + "-" + randStr(sessionKeyLength)
+		store.set(ctx, key, storeValue{UserID: userID, Expires: now.Add(maxExpiry), MaxExpiry: now.Add(maxExpiry)})
+		return key
+	}
+
+	// The index lives as long as the session that expires last
+	set(time.Hour)
+	assert.InDelta(t, time.Hour, server.TTL(index), float64(time.Second), "Index should expire with its session")
+	set(2 * time.Hour)
+	assert.InDelta(t, 2*time.Hour, server.TTL(index), float64(time.Second), "Index expiry should be extended")
+	key := set(30 * time.Minute)
+	assert.InDelta(t, 2*time.Hour, server.TTL(index), float64(time.Second), "Index expiry should not be shortened")
+	store.replace(ctx, key, userID+"-"+randStr(sessionKeyLength), func(*storeValue) error { return nil })
+	assert.InDelta(t, 2*time.Hour, server.TTL(index), float64(time.Second), "Index expiry should not be shortened")
+
+	server.FastForward(2*time.Hour + time.Second)
+	assert.False(t, server.Exists(index), "Index should expire with the last of its sessions")
+}
+
+func TestRedisUserIndexTrim(t *testing.T) {
+	store, server := testRedisStore(t)
+	ctx := context.Background()
+	userID := randStr(64)
+	index := store.userIndex(userID)
+	expiry := time.Now().Add(time.Hour)
+	stale := func() {
+		// Sessions past their forced expiry, still held as if Redis had yet to expire them
+		past := time.Now().Add(-time.Minute)
+		for i := 0; i < 10; i++ {
+			key := store.formatKey(userID + "-" + randStr(sessionKeyLength))
+			server.Set(key, string(encodeGob(storeValue{UserID: userID, Expires: past, MaxExpiry: past})))
+			server.ZAdd(index, float64(indexScore(past)), key)
+		}
+	}
+
+	// Stale members are dropped when reading the index
+	live := userID + "-" + randStr(sessionKeyLength)
+	store.set(ctx, live, storeValue{UserID: userID, Expires: expiry, MaxExpiry: expiry})
+	stale()
+	sessions, err := store.userSessions(ctx, userID)
+	assert.Empty(t, err, "Error listing sessions")
+	assert.Equal(t, []string{live}, mapKeys(sessions), "Stale sessions should not be listed")
+	members, _ := server.ZMembers(index)
+	assert.Len(t, members, 1, "Stale members should be dropped from the index")
+
+	// And when adding to it
+	stale()
+	store.set(ctx, userID+"-"+randStr(sessionKeyLength), storeValue{UserID: userID, Expires: expiry, MaxExpiry: expiry})
+	members, _ = server.ZMembers(index)
+	assert.Len(t, members, 2, "Stale members should be dropped from the index")
+}
+
+func TestRedisStoreUnsetAllConcurrent(t *testing.T) {
+	store, server := testRedisStore(t)
+	ctx := context.Background()
+	userID := randStr(64)
+	expiry := time.Now().Add(time.Hour)
+
+	// A session stored while the user's sessions are being removed is either
+	// removed with them or kept in the index, never left out of it
+	for i := 0; i < 50; i++ {
+		var wg sync.WaitGroup
+		for worker := 0; worker < 4; worker++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				store.set(ctx, userID+"-"+randStr(sessionKeyLength), storeValue{UserID: userID, Expires: expiry, MaxExpiry: expiry})
+			}()
+			go func() {
+				defer wg.Done()
+				store.unsetAll(ctx, userID)
+			}()
+		}
+		wg.Wait()
+	}
+	sessions, err := store.userSessions(ctx, userID)
+	assert.Empty(t, err, "Error listing sessions")
+	assert.Len(t, redisSessionKeys(server, store), len(sessions), "Every session left should be in the index")
+}
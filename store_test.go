@@ -1,6 +1,7 @@
 package authlib
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -11,11 +12,11 @@ func TestStore(t *testing.T) {
 	key := randStr(64)
 	value := randStr(64)
 
-	getStore("localhost:6379", "").set(key, storeValue{
+	getStore("", "", nopLogger{}).set(context.Background(), key, storeValue{
 		HashedToken: value,
 		MaxExpiry:   time.Now().Add(time.Minute),
 	})
-	storedValue, found := getStore("localhost:6379", "").get(key)
+	storedValue, found, _ := getStore("", "", nopLogger{}).get(context.Background(), key)
 	assert.True(t, found, "Not found")
 	assert.Equal(t, value, storedValue.HashedToken, "Wrong value")
 }
@@ -12,15 +12,16 @@ import (
 type ComparePasswordOpts struct {
 	Password    string
 	EncodedHash string
+
+	// Deprecated: Pass a context carrying the span to ComparePasswordAndHashContext instead.
 	SpanContext opentracing.SpanContext
 }
 
 // cookieOpts is the structure of the cookie that is used
 // to authenticate users after they have logged in.
 type cookieOpts struct {
-	key         string
-	token       string
-	spanContext opentracing.SpanContext
+	key   string
+	token string
 }
 
 // cookieValue contains the data that will be stored as a secure cookie
@@ -35,30 +36,53 @@ type storeValue struct {
 	UserID      string
 	Expires     time.Time
 	MaxExpiry   time.Time
+	AuthTime    time.Time         // When the user last authenticated, by logging in or reauthenticating
+	AuthMethod  AuthMethod        // How the user last authenticated
+	Origin      AuthMethod        // How the session was established
+	Data        map[string][]byte // Session data set through Session.Set, encoded with the SessionCodec
 }
 
 type saveLoginOpts struct {
-	userID      string
-	rmbMe       bool
-	w           http.ResponseWriter
-	spanContext opentracing.SpanContext
+	userID string
+	rmbMe  bool
+	method AuthMethod
+	w      http.ResponseWriter
 }
 
 // HashPasswordOpts bundles the options for hashing a password.
 type HashPasswordOpts struct {
-	Password    string
-	SpanContext opentracing.SpanContext // Used for instrumenting with opentracing API
+	Password string
+
+	// Deprecated: Pass a context carrying the span to HashPasswordContext instead.
+	SpanContext opentracing.SpanContext
 }
 
 // AttemptLoginOpts bundles the options for logging a user in.
 // It contains the login details that is being passed in to be checked & stored.
 type AttemptLoginOpts struct {
 	HTTPWriter       http.ResponseWriter
-	ID               string // Unique identifier of the user
+	HTTPRequest      *http.Request // The login request, used to record the IP and user agent in audit events. Optional.
+	ID               string        // Unique identifier of the user
 	ProvidedPassword string
 	PasswordHash     string
 	RmbMe            bool
-	SpanContext      opentracing.SpanContext // Used for instrumenting with opentracing API
+
+	// Deprecated: Pass a context carrying the span to AttemptLoginContext instead.
+	SpanContext opentracing.SpanContext
+}
+
+// loginOpts bundles the options for logging in a user without a password.
+type loginOpts struct {
+	HTTPWriter http.ResponseWriter
+	ID         string // Unique identifier of the user
+	RmbMe      bool
+}
+
+// ReauthenticateOpts bundles the options for reauthenticating a logged in user.
+type ReauthenticateOpts struct {
+	HTTPRequest      *http.Request // The request carrying the user's auth cookie
+	ProvidedPassword string
+	PasswordHash     string
 }
 
 // HTTPOpts contains the http.ResponseWriter and http.Request objects,
@@ -66,5 +90,65 @@ type AttemptLoginOpts struct {
 type HTTPOpts struct {
 	HTTPWriter  http.ResponseWriter
 	HTTPRequest *http.Request
-	SpanContext opentracing.SpanContext // Used for instrumenting with opentracing API
+
+	// Deprecated: Pass a context carrying the span to the ...Context variants instead,
+	// or attach it to the request's context.
+	SpanContext opentracing.SpanContext
+}
+
+// IssueTokensOpts bundles the options for issuing an access and refresh token.
+type IssueTokensOpts struct {
+	UserID string
+
+	// Deprecated: Pass a context carrying the span to IssueTokensContext instead.
+	SpanContext opentracing.SpanContext
+}
+
+// RefreshOpts bundles the options for using or revoking a refresh token.
+type RefreshOpts struct {
+	RefreshToken string
+
+	// Deprecated: Pass a context carrying the span to RefreshContext
+	// or RevokeRefreshTokenContext instead.
+	SpanContext opentracing.SpanContext
+}
+
+// VerifyAccessTokenOpts bundles the options for verifying an access token.
+type VerifyAccessTokenOpts struct {
+	AccessToken string
+
+	// Deprecated: Pass a context carrying the span to VerifyAccessTokenContext instead.
+	SpanContext opentracing.SpanContext
+}
+
+// ListSessionsOpts bundles the options for listing the sessions of a user.
+type ListSessionsOpts struct {
+	UserID string
+
+	// Deprecated: Pass a context carrying the span to ListSessionsContext instead.
+	SpanContext opentracing.SpanContext
+}
+
+// TokenPair is a newly issued access token, along with the refresh token
+// that can be used to obtain the next one.
+type TokenPair struct {
+	AccessToken         string
+	AccessTokenExpires  time.Time
+	RefreshToken        string
+	RefreshTokenExpires time.Time
+}
+
+// SessionStatus describes a login checked by CheckSession.
+type SessionStatus struct {
+	UserID    string // Set for valid logins, and for some invalid ones, e.g. an expired remember me token
+	SessionID string // Identifies the session, as in audit events
+	Valid     bool
+
+	Origin      AuthMethod // How the session was established, e.g. AuthPassword or AuthRmbMe
+	AuthMethod  AuthMethod // How the user last authenticated, which changes on Reauthenticate
+	AuthTime    time.Time  // When the user last authenticated
+	Resurrected bool       // Whether the session was just created from a remember me cookie, by this check
+
+	IdleRemaining     time.Duration // Until the session expires, unless used again
+	AbsoluteRemaining time.Duration // Until the session expires, however often it is used
 }
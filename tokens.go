@@ -0,0 +1,253 @@
+package authlib
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/securecookie"
+)
+
+// IssueTokens creates a short-lived signed access token and a long-lived
+// opaque refresh token for a user. Called after the user has been
+// authenticated, e.g. by a token endpoint that checked their password.
+func (a *Object) IssueTokens(opts IssueTokensOpts) (tokens TokenPair, err error) {
+	return a.IssueTokensContext(context.Background(), opts)
+}
+
+// IssueTokensContext is IssueTokens, traced as a child of the span in ctx.
+func (a *Object) IssueTokensContext(ctx context.Context, opts IssueTokensOpts) (tokens TokenPair, err error) {
+	ctx, span := a.startSpan(ctx, "authlib-issueTokens", opts.SpanContext)
+	defer span.end()
+	span.setUserID(opts.UserID)
+
+	tokens, err = a.issueTokens(ctx, Store{UserID: opts.UserID}, "")
+	span.setError(err)
+	return
+}
+
+// Refresh exchanges a refresh token for a new access token and refresh token.
+// The presented refresh token is invalidated, so each refresh token can only be used once.
+// Presenting a refresh token that has already been used revokes every refresh token
+// descended from the same login, as it indicates the token has been stolen.
+// ErrInvalidRefreshToken is only returned for tokens that are unknown, revoked or
+// expired; if the database cannot be reached, a *StoreError is returned instead,
+// and the client should retry. If a BeforeLogin hook rejects the user, the hook's
+// error is returned, and every refresh token descended from the same login is revoked.
+func (a *Object) Refresh(opts RefreshOpts) (tokens TokenPair, err error) {
+	return a.RefreshContext(context.Background(), opts)
+}
+
+// RefreshContext is Refresh, traced as a child of the span in ctx.
+func (a *Object) RefreshContext(ctx context.Context, opts RefreshOpts) (tokens TokenPair, err error) {
+	ctx, span := a.startSpan(ctx, "authlib-refresh", opts.SpanContext)
+	defer span.end()
+
+	tokens, err = a.refresh(ctx, opts.RefreshToken)
+	span.setError(err)
+	return
+}
+
+func (a *Object) refresh(ctx context.Context, refreshToken string) (tokens TokenPair, err error) {
+	value, err := a.decodeRefreshToken(refreshToken)
+	if err != nil {
+		return
+	}
+
+	entry, err := a.checkRmbMeInDB(ctx, cookieOpts{
+		key:   value.Key,
+		token: value.Token,
+	})
+	if err == nil && entry.UserID != "" {
+		if err = a.allowFamilyLogin(ctx, nil, entry, AuditRefresh); err != nil {
+			return TokenPair{}, err
+		}
+		// Rotate the refresh token, keeping it in the same family
+		tokens, err = a.issueTokens(ctx, entry, value.Key)
+		if err == nil {
+			return tokens, nil
+		}
+	}
+	switch {
+	case err == ErrTokenReuse:
+		a.audit(ctx, nil, AuditEvent{
+			Type:    AuditTokenReuse,
+			UserID:  entry.UserID,
+			Outcome: AuditRevoked,
+			Reason:  "a rotated refresh token was presented again",
+		})
+		return TokenPair{}, err
+	case ctx.Err() != nil, errors.Is(err, ErrStoreUnavailable):
+		// The token may still be valid, so clients should retry rather than log the user out
+		return TokenPair{}, err
+	}
+	return TokenPair{}, ErrInvalidRefreshToken
+}
+
+// RevokeRefreshToken invalidates a refresh token, e.g. when a client logs out.
+// Access tokens that have already been issued remain valid until they expire.
+func (a *Object) RevokeRefreshToken(opts RefreshOpts) {
+	a.RevokeRefreshTokenContext(context.Background(), opts)
+}
+
+// RevokeRefreshTokenContext is RevokeRefreshToken, traced as a child of the span in ctx.
+func (a *Object) RevokeRefreshTokenContext(ctx context.Context, opts RefreshOpts) {
+	ctx, span := a.startSpan(ctx, "authlib-revokeRefreshToken", opts.SpanContext)
+	defer span.end()
+
+	value, err := a.decodeRefreshToken(opts.RefreshToken)
+	if err == nil {
+		_, err = a.revokeRmbMe(ctx, value.Key)
+		span.setError(err)
+	}
+}
+
+// VerifyAccessToken checks the signature and expiry of an access token,
+// returning its claims if valid. The user ID is held in the Subject claim.
+func (a *Object) VerifyAccessToken(opts VerifyAccessTokenOpts) (claims AccessClaims, err error) {
+	return a.VerifyAccessTokenContext(context.Background(), opts)
+}
+
+// VerifyAccessTokenContext is VerifyAccessToken, traced as a child of the span in ctx.
+func (a *Object) VerifyAccessTokenContext(ctx context.Context, opts VerifyAccessTokenOpts) (claims AccessClaims, err error) {
+	_, span := a.startSpan(ctx, "authlib-verifyAccessToken", opts.SpanContext)
+	defer span.end()
+
+	claims, err = verifyJWT(opts.AccessToken, a.tokenKeys(), a.config.now())
+	if err == nil && claims.Issuer != a.config.TokenIssuer {
+		claims, err = AccessClaims{}, ErrInvalidToken
+	}
+	span.setUserID(claims.Subject)
+	span.setError(err)
+	return
+}
+
+// JWKS returns the public keys used to sign access tokens as a JSON Web Key Set,
+// so that other services can verify tokens without calling back into authlib.
+// Tokens signed with the HS256 KMS key can only be verified by VerifyAccessToken,
+// as the key is secret.
+func (a *Object) JWKS() ([]byte, error) {
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{Keys: []jsonWebKey{}}
+
+	for _, key := range a.tokenKeys() {
+		if jwk, ok := key.publicJWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return json.Marshal(set)
+}
+
+// JWKSHandler serves the output of JWKS, typically mounted on
+// /.well-known/jwks.json.
+func (a *Object) JWKSHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := a.JWKS()
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+}
+
+// tokenKeys returns the keys that access tokens can be signed with.
+// The first key is used for signing, while all of them are accepted when verifying.
+// KMS token keys replaced by RotateKMSFile come last, and are only used to verify.
+func (a *Object) tokenKeys() []jwtKey {
+	keys := make([]jwtKey, 0, len(a.config.SigningKeys)+len(a.kms.Previous)+1)
+	for _, key := range a.config.SigningKeys {
+		keys = append(keys, jwtKey{
+			id:     key.ID,
+			alg:    key.Algorithm,
+			signer: key.Key,
+		})
+	}
+	keys = append(keys, jwtKey{
+		id:     kmsTokenKeyID,
+		alg:    AlgHS256,
+		secret: a.kms.TokenKey,
+	})
+	for _, previous := range a.kms.Previous {
+		if len(previous.TokenKey) > 0 {
+			keys = append(keys, jwtKey{
+				id:     kmsTokenKeyID,
+				alg:    AlgHS256,
+				secret: previous.TokenKey,
+			})
+		}
+	}
+	return keys
+}
+
+// issueTokens creates a token pair for the user of the given refresh token family.
+// An empty family ID starts a new family. When exchanging a refresh token, rotatedKey
+// is its key, which is marked rotated in the same step as the new token is stored.
+func (a *Object) issueTokens(ctx context.Context, family Store, rotatedKey string) (tokens TokenPair, err error) {
+	accessTimeout := a.config.AccessTokenTimeout
+	refreshTimeout := a.config.RefreshTokenTimeout
+
+	now := a.config.now()
+	tokens.AccessTokenExpires = now.Add(accessTimeout)
+	tokens.RefreshTokenExpires = now.Add(refreshTimeout)
+
+	tokens.AccessToken, err = signJWT(a.tokenKeys()[0], AccessClaims{
+		Issuer:    a.config.TokenIssuer,
+		Subject:   family.UserID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: tokens.AccessTokenExpires.Unix(),
+		ID:        base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(16)),
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	// Refresh tokens are stored the same way as remember me tokens,
+	// and handed out as an encrypted payload of the key and token.
+	key, token, entry, err := a.newRmbMe(ctx, family, refreshTimeout)
+	if err == nil {
+		if rotatedKey == "" {
+			err = storeError("insert refresh token", a.db.Insert(ctx, key, entry))
+		} else if found, claimErr := a.claimToken(ctx, rotatedKey, key, entry); claimErr != nil {
+			err = claimErr
+		} else if !found {
+			// Revoked in the meantime
+			err = ErrInvalidRefreshToken
+		}
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return TokenPair{}, ctxErr
+	}
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if entry.Expires.Before(tokens.RefreshTokenExpires) {
+		// Capped by the lifetime of the family
+		tokens.RefreshTokenExpires = entry.Expires
+	}
+	tokens.RefreshToken, err = a.sc.encode("refresh", cookieValue{
+		Key:     key,
+		Token:   token,
+		Expires: tokens.RefreshTokenExpires,
+	})
+	if err != nil {
+		a.db.RemoveSingle(ctx, key)
+		return TokenPair{}, err
+	}
+	return
+}
+
+// decodeRefreshToken decrypts a refresh token, rejecting it if it has expired.
+func (a *Object) decodeRefreshToken(refreshToken string) (value cookieValue, err error) {
+	if err = a.sc.decode("refresh", refreshToken, &value); err != nil {
+		return cookieValue{}, ErrInvalidRefreshToken
+	}
+	if value.Expires.Before(a.config.now()) {
+		return cookieValue{}, ErrInvalidRefreshToken
+	}
+	return value, nil
+}
@@ -0,0 +1,168 @@
+package authlib
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIssueAndRefreshTokens(t *testing.T) {
+	a := testObject()
+	userID := randStr(64)
+
+	tokens, err := a.IssueTokens(IssueTokensOpts{UserID: userID})
+	assert.Empty(t, err, "Error issuing tokens")
+
+	claims, err := a.VerifyAccessToken(VerifyAccessTokenOpts{AccessToken: tokens.AccessToken})
+	assert.Empty(t, err, "Error verifying access token")
+	assert.Equal(t, userID, claims.Subject, "Wrong user ID in access token")
+
+	refreshed, err := a.Refresh(RefreshOpts{RefreshToken: tokens.RefreshToken})
+	assert.Empty(t, err, "Error refreshing tokens")
+	assert.NotEqual(t, tokens.RefreshToken, refreshed.RefreshToken, "Refresh token was not rotated")
+
+	a.RevokeRefreshToken(RefreshOpts{RefreshToken: refreshed.RefreshToken})
+	_, err = a.Refresh(RefreshOpts{RefreshToken: refreshed.RefreshToken})
+	assert.Equal(t, ErrInvalidRefreshToken, err, "Revoked refresh token should not have been accepted")
+
+	_, err = a.Refresh(RefreshOpts{RefreshToken: randStr(64)})
+	assert.Equal(t, ErrInvalidRefreshToken, err, "Manipulated refresh token should not have been accepted")
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	a := testObject()
+	tokens, err := a.IssueTokens(IssueTokensOpts{UserID: randStr(64)})
+	assert.Empty(t, err, "Error issuing tokens")
+
+	refreshed, err := a.Refresh(RefreshOpts{RefreshToken: tokens.RefreshToken})
+	assert.Empty(t, err, "Error refreshing tokens")
+
+	_, err = a.Refresh(RefreshOpts{RefreshToken: tokens.RefreshToken})
+	assert.Equal(t, ErrTokenReuse, err, "Reuse of refresh token should have been detected")
+
+	_, err = a.Refresh(RefreshOpts{RefreshToken: refreshed.RefreshToken})
+	assert.Equal(t, ErrInvalidRefreshToken, err, "Refresh token family should have been revoked")
+}
+
+func TestRefreshStoreUnavailable(t *testing.T) {
+	a := testObject()
+	// Use a database of its own, as the default one is shared
+	a.db = &database{}
+	a.db.init(testDBPath)
+	tokens, err := a.IssueTokens(IssueTokensOpts{UserID: randStr(64)})
+	assert.Empty(t, err, "Error issuing tokens")
+
+	a.db.Close()
+	_, err = a.Refresh(RefreshOpts{RefreshToken: tokens.RefreshToken})
+	assert.ErrorIs(t, err, ErrStoreUnavailable, "Outage should be reported as such")
+	assert.NotErrorIs(t, err, ErrInvalidRefreshToken, "Outage should not invalidate the token")
+
+	// The token still works once the database is back
+	a.db.Connected = true
+	_, err = a.Refresh(RefreshOpts{RefreshToken: tokens.RefreshToken})
+	assert.Empty(t, err, "Token should be accepted once the database is back")
+}
+
+func TestRefreshTokenConcurrentReplay(t *testing.T) {
+	audit := &MemoryAuditSink{}
+	config := testObject().config
+	config.AuditSink = audit
+	a := New(config)
+	tokens, err := a.IssueTokens(IssueTokensOpts{UserID: randStr(64)})
+	assert.Empty(t, err, "Error issuing tokens")
+
+	// Several requests present the same refresh token at once, as if it had been stolen
+	const replays = 8
+	results := make([]TokenPair, replays)
+	errs := make([]error, replays)
+	var wg sync.WaitGroup
+	for i := 0; i < replays; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = a.Refresh(RefreshOpts{RefreshToken: tokens.RefreshToken})
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded, reused := 0, 0
+	var refreshed TokenPair
+	for i, err := range errs {
+		switch err {
+		case nil:
+			succeeded++
+			refreshed = results[i]
+		case ErrTokenReuse:
+			reused++
+		default:
+			assert.Equal(t, ErrInvalidRefreshToken, err, "Replays should be rejected")
+		}
+	}
+	assert.Equal(t, 1, succeeded, "Exactly one replay should be refreshed")
+	assert.NotZero(t, reused, "Reuse should be detected")
+	_, err = a.Refresh(RefreshOpts{RefreshToken: refreshed.RefreshToken})
+	assert.Equal(t, ErrInvalidRefreshToken, err, "Refresh token family should have been revoked")
+
+	events := audit.Events()
+	if assert.NotEmpty(t, events, "Reuse should be audited") {
+		assert.Equal(t, AuditTokenReuse, events[0].Type, "Reuse should be audited")
+	}
+}
+
+func TestAccessTokenAfterKMSRotation(t *testing.T) {
+	a := testObject()
+	tokens, err := a.IssueTokens(IssueTokensOpts{UserID: randStr(64)})
+	assert.Empty(t, err, "Error issuing tokens")
+
+	// Restarting with a rotated KMS file keeps the previous token key for verifying
+	rotated := generateKMS()
+	rotated.Previous = []previousKeys{{TokenKey: a.kms.TokenKey}}
+	a.kms = &rotated
+	_, err = a.VerifyAccessToken(VerifyAccessTokenOpts{AccessToken: tokens.AccessToken})
+	assert.Empty(t, err, "Token signed before the rotation should be accepted")
+
+	issued, err := a.IssueTokens(IssueTokensOpts{UserID: randStr(64)})
+	assert.Empty(t, err, "Error issuing tokens")
+	_, err = testObject().VerifyAccessToken(VerifyAccessTokenOpts{AccessToken: issued.AccessToken})
+	assert.ErrorIs(t, err, ErrInvalidToken, "New tokens should be signed with the new key")
+
+	// Rotating without keeping the keys rejects every token
+	rotated.Previous = nil
+	_, err = a.VerifyAccessToken(VerifyAccessTokenOpts{AccessToken: tokens.AccessToken})
+	assert.ErrorIs(t, err, ErrInvalidToken, "Token signed with a discarded key should be rejected")
+}
+
+func TestAsymmetricTokensAndJWKS(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	config := testObject().config
+	config.TokenIssuer = "authlib-test"
+	config.AccessTokenTimeout = time.Minute
+	config.SigningKeys = []SigningKey{{ID: "ed-1", Algorithm: AlgEdDSA, Key: edKey}}
+	a := New(config)
+
+	tokens, err := a.IssueTokens(IssueTokensOpts{UserID: randStr(64)})
+	assert.Empty(t, err, "Error issuing tokens")
+	_, err = a.VerifyAccessToken(VerifyAccessTokenOpts{AccessToken: tokens.AccessToken})
+	assert.Empty(t, err, "Error verifying access token")
+
+	// Tokens from a different issuer should be rejected
+	_, err = testObject().VerifyAccessToken(VerifyAccessTokenOpts{AccessToken: tokens.AccessToken})
+	assert.NotEmpty(t, err, "Token from a different issuer should not have been accepted")
+
+	body, err := a.JWKS()
+	assert.Empty(t, err, "Error exporting JWKS")
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	assert.Empty(t, json.Unmarshal(body, &set), "JWKS is not valid JSON")
+	if assert.Len(t, set.Keys, 1, "Only the asymmetric key should be exported") {
+		assert.Equal(t, "ed-1", set.Keys[0]["kid"])
+		assert.Equal(t, "OKP", set.Keys[0]["kty"])
+		assert.Equal(t, "Ed25519", set.Keys[0]["crv"])
+	}
+}
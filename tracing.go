@@ -0,0 +1,130 @@
+package authlib
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies authlib as the instrumentation library in OpenTelemetry.
+const tracerName = "github.com/kaphos/authlib"
+
+// Span attribute keys.
+const (
+	attrOutcome      = attribute.Key("authlib.outcome")
+	attrUserID       = attribute.Key("enduser.id")
+	attrStoreLatency = attribute.Key("authlib.store.latency_ms")
+)
+
+// span adapts an OpenTelemetry span and an opentracing span into one,
+// so that callers still using opentracing see the same operations.
+// The opentracing span is only created when an opentracing parent is present,
+// either passed in explicitly or carried in the context.
+type span struct {
+	otel    trace.Span
+	ot      opentracing.Span
+	userKey []byte // Key that user IDs are hashed with, nil to record them as is
+}
+
+// tracer returns the tracer from the configured provider, or the global provider.
+func (c Config) tracer() trace.Tracer {
+	if c.TracerProvider == nil {
+		return otel.Tracer(tracerName)
+	}
+	return c.TracerProvider.Tracer(tracerName)
+}
+
+// startSpan starts a span as a child of the spans in ctx, and of otParent if given.
+// The returned context carries the new span(s), to be passed down to child operations.
+func (a *Object) startSpan(ctx context.Context, name string, otParent opentracing.SpanContext) (context.Context, *span) {
+	return startSpan(ctx, a.config.tracer(), name, otParent, a.spanUserKey)
+}
+
+func startSpan(ctx context.Context, tracer trace.Tracer, name string, otParent opentracing.SpanContext, userKey []byte) (context.Context, *span) {
+	s := &span{userKey: userKey}
+	ctx, s.otel = tracer.Start(ctx, name)
+
+	if otParent == nil {
+		if parent := opentracing.SpanFromContext(ctx); parent != nil {
+			otParent = parent.Context()
+		}
+	}
+	if otParent != nil {
+		s.ot = opentracing.StartSpan(name, opentracing.ChildOf(otParent))
+		ctx = opentracing.ContextWithSpan(ctx, s.ot)
+	}
+	return ctx, s
+}
+
+// hashSpanUserID hashes a user ID for recording on spans.
+func hashSpanUserID(key []byte, userID string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(userID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *span) setOutcome(outcome string) {
+	s.otel.SetAttributes(attrOutcome.String(outcome))
+	if s.ot != nil {
+		s.ot.SetTag(string(attrOutcome), outcome)
+	}
+}
+
+// setUserID records the user ID, hashed with HMAC-SHA256 if configured. A keyed hash
+// is used so that user IDs cannot be recovered by hashing guesses, such as email addresses.
+func (s *span) setUserID(userID string) {
+	if userID == "" {
+		return
+	}
+	if s.userKey != nil {
+		userID = hashSpanUserID(s.userKey, userID)
+	}
+	s.otel.SetAttributes(attrUserID.String(userID))
+	if s.ot != nil {
+		s.ot.SetTag(string(attrUserID), userID)
+	}
+}
+
+// setStoreLatency records how long a call to the session store took.
+func (s *span) setStoreLatency(start time.Time) {
+	latency := float64(time.Since(start)) / float64(time.Millisecond)
+	s.otel.SetAttributes(attrStoreLatency.Float64(latency))
+	if s.ot != nil {
+		s.ot.SetTag(string(attrStoreLatency), latency)
+	}
+}
+
+// setError marks the span as failed.
+func (s *span) setError(err error) {
+	if err == nil {
+		return
+	}
+	s.otel.RecordError(err)
+	s.otel.SetStatus(codes.Error, err.Error())
+	if s.ot != nil {
+		s.ot.SetTag("error", true)
+	}
+}
+
+func (s *span) end() {
+	s.otel.End()
+	if s.ot != nil {
+		s.ot.Finish()
+	}
+}
+
+// contextOf returns the request's context, or the background context if there is no request.
+func contextOf(opts HTTPOpts) context.Context {
+	if opts.HTTPRequest == nil {
+		return context.Background()
+	}
+	return opts.HTTPRequest.Context()
+}
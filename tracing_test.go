@@ -0,0 +1,91 @@
+package authlib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestOpenTelemetrySpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	config := testObject().config
+	config.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	config.HashSpanUserIDs = true
+	a := New(config)
+
+	id := randStr(64)
+	pw := randStr(64)
+	ok, err := a.AttemptLoginContext(context.Background(), AttemptLoginOpts{
+		HTTPWriter:       httptest.NewRecorder(),
+		ID:               id,
+		ProvidedPassword: pw,
+		PasswordHash:     a.HashPassword(HashPasswordOpts{Password: pw}),
+	})
+	assert.True(t, ok, "Login was not accepted")
+	assert.Empty(t, err, "An error occurred while logging in")
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	login, found := spans["authlib-attemptLogin"]
+	if !assert.True(t, found, "Login span was not recorded") {
+		return
+	}
+	attrs := map[string]string{}
+	for _, kv := range login.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	sum := sha256.Sum256([]byte(id))
+	assert.Equal(t, loginSuccess, attrs[string(attrOutcome)], "Wrong outcome recorded")
+	assert.Equal(t, hashSpanUserID(a.kms.spanUserKey(), id), attrs[string(attrUserID)], "User ID should have been hashed")
+	assert.NotEqual(t, hex.EncodeToString(sum[:]), attrs[string(attrUserID)], "User ID should be hashed with a key")
+
+	saveLogin, found := spans["authlib-saveLogin"]
+	if assert.True(t, found, "Child span was not recorded") {
+		assert.Equal(t, login.SpanContext().SpanID(), saveLogin.Parent().SpanID(), "Child span has the wrong parent")
+	}
+}
+
+func TestOpentracingAdapter(t *testing.T) {
+	tracer := mocktracer.New()
+	previous := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(previous)
+
+	a := testObject()
+	pw := randStr(64)
+	parent := tracer.StartSpan("parent")
+	a.AttemptLogin(AttemptLoginOpts{
+		HTTPWriter:       httptest.NewRecorder(),
+		ID:               randStr(64),
+		ProvidedPassword: pw,
+		PasswordHash:     a.HashPassword(HashPasswordOpts{Password: pw}),
+		SpanContext:      parent.Context(),
+	})
+	parent.Finish()
+
+	spans := map[string]*mocktracer.MockSpan{}
+	for _, span := range tracer.FinishedSpans() {
+		spans[span.OperationName] = span
+	}
+	login, found := spans["authlib-attemptLogin"]
+	if !assert.True(t, found, "Login span was not recorded with opentracing") {
+		return
+	}
+	assert.Equal(t, parent.(*mocktracer.MockSpan).SpanContext.SpanID, login.ParentID, "Login span has the wrong parent")
+	assert.Equal(t, loginSuccess, login.Tag(string(attrOutcome)), "Wrong outcome recorded")
+
+	saveLogin, found := spans["authlib-saveLogin"]
+	if assert.True(t, found, "Child span was not recorded with opentracing") {
+		assert.Equal(t, login.SpanContext.SpanID, saveLogin.ParentID, "Child span has the wrong parent")
+	}
+}